@@ -0,0 +1,306 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paddycarver/gcp-proxy-test/proxytest"
+)
+
+// Defaults for the long-running modes.
+const (
+	// defaultServeInterval is how often checks run in -serve mode.
+	defaultServeInterval = time.Minute
+
+	defaultStressRate        = 10
+	defaultStressConcurrency = 20
+)
+
+// options holds the command line settings that control how the tool itself
+// behaves, as opposed to how it talks to Google.
+type options struct {
+	configFile      string
+	output          string
+	quiet           bool
+	noColor         bool
+	debug           bool
+	logLevel        string
+	logFormat       string
+	version         bool
+	dumpEnv         bool
+	listChecks      bool
+	credentialsList []string
+	validateOnly    bool
+	verifyRefresh   bool
+	showCertChain   bool
+	bundleOut       string
+	tokenStdin      bool
+	printConfig     bool
+	watch           time.Duration
+
+	stress            time.Duration
+	stressRate        int
+	stressConcurrency int
+	serve             string
+	serveInterval     time.Duration
+
+	exitCodes map[string]int
+}
+
+// bindFlags registers the command line flags for conf and opts. Flags are
+// bound after the environment has been read, so their defaults are the
+// environment's values and a flag always takes precedence over its variable.
+func bindFlags(fs *flag.FlagSet, conf *proxytest.Config, opts *options) {
+	fs.StringVar(&opts.configFile, "config", opts.configFile,
+		"`path` to a YAML or TOML config file; the environment and flags override its settings")
+	fs.StringVar(&opts.output, "output", proxytest.OutputText,
+		"output `format`: text, json, or jsonl for a JSON object per result as it comes")
+	fs.BoolVar(&opts.noColor, "no-color", opts.noColor,
+		"don't color text output; it's also uncolored when NO_COLOR is set or output isn't a terminal")
+	fs.BoolVar(&opts.quiet, "quiet", opts.quiet,
+		"only print a single PASS or FAIL line once the run is finished; logs are still controlled by -debug and -log-level")
+	fs.Var((*listValue)(&opts.credentialsList), "credentials-list",
+		"comma-separated `paths` of credentials files to run every check with, comparing the results")
+	fs.BoolVar(&opts.validateOnly, "validate-only", opts.validateOnly,
+		"only load the credentials and mint a token, printing the identity and expiry, without calling any API")
+	fs.BoolVar(&opts.verifyRefresh, "verify-refresh", opts.verifyRefresh,
+		"only check that a second token can be minted once the first has expired, as happens in long runs")
+	fs.BoolVar(&opts.printConfig, "print-config", opts.printConfig,
+		"only print the effective config, once the config file, environment, and flags are merged, with secrets redacted")
+	fs.BoolVar(&opts.showCertChain, "show-cert-chain", opts.showCertChain,
+		"only print the certificate chain each API host presents, e.g. to see whether a proxy intercepts TLS")
+	fs.StringVar(&opts.bundleOut, "bundle-out", opts.bundleOut,
+		"run every check, then write a support bundle of the environment, DNS, results, and certificates, with secrets redacted, to this .tar.gz `path`")
+	fs.StringVar(&opts.serve, "serve", opts.serve,
+		"listen on `address`, e.g. :9000, and run the checks repeatedly, exposing Prometheus metrics on /metrics and readiness on /healthz")
+	fs.DurationVar(&opts.serveInterval, "serve-interval", defaultServeInterval,
+		"`duration` between runs of the checks with -serve")
+	fs.DurationVar(&opts.watch, "watch", opts.watch,
+		"run the checks every `interval`, printing a line per run and calling out changes, until interrupted")
+	fs.DurationVar(&opts.stress, "stress", opts.stress,
+		"only send billing and org requests at -stress-rate for this `duration`, reporting the success rate, latency percentiles, and errors")
+	fs.IntVar(&opts.stressRate, "stress-rate", defaultStressRate,
+		"`number` of requests a second to send with -stress, at most 1000")
+	fs.IntVar(&opts.stressConcurrency, "stress-concurrency", defaultStressConcurrency,
+		"maximum `number` of requests in flight at once with -stress")
+	opts.exitCodes = maps.Clone(defaultExitCodes)
+	fs.Var(exitCodeMapValue(opts.exitCodes), "exit-code-map",
+		"comma-separated category=`code` pairs setting the exit code of failed runs by category; other failures exit 6, and if several categories fail, the first of "+strings.Join(proxytest.Categories(), ", ")+" decides")
+	fs.BoolVar(&opts.version, "version", opts.version,
+		"print the versions of the tool and its dependencies, then exit")
+	fs.BoolVar(&opts.listChecks, "list-checks", opts.listChecks,
+		"print every check, with what it does and needs to run, then exit")
+	fs.BoolVar(&opts.dumpEnv, "dump-env", opts.dumpEnv,
+		"print the environment variables that affect the tool, with secrets redacted, then exit")
+	fs.BoolVar(&opts.debug, "debug", opts.debug,
+		"log every request and response; the same as setting TF_LOG=DEBUG")
+	fs.StringVar(&opts.logLevel, "log-level", opts.logLevel,
+		"minimum `level` of diagnostic logs, e.g. WARN; the same as setting TF_LOG")
+	fs.StringVar(&opts.logFormat, "log-format", proxytest.LogFormatText,
+		"`format` of diagnostic logs on stderr, either text or json")
+
+	fs.BoolVar(&conf.ReloadCredentials, "reload-credentials", conf.ReloadCredentials,
+		"with -watch or -serve, re-read the credentials before each run after the first, e.g. to pick up rotated keys, reporting if the identity changed")
+	fs.BoolVar(&opts.tokenStdin, "token-stdin", opts.tokenStdin,
+		"read an access token from stdin, so it isn't on the command line or in a file")
+	fs.StringVar(&conf.TokenCommand, "token-command", conf.TokenCommand,
+		"`command` that prints an access token, e.g. \"gcloud auth print-access-token\"; run again as tokens expire (env GCP_TOKEN_COMMAND)")
+	fs.StringVar(&conf.ProxyURL, "proxy", conf.ProxyURL,
+		"`URL` of an HTTP(S) or SOCKS5 proxy, overriding HTTPS_PROXY (env GCP_PROXY_URL)")
+	fs.IntVar(&conf.MaxIdleConns, "max-idle-conns", conf.MaxIdleConns,
+		"maximum `number` of idle connections kept for reuse; 0 is unlimited")
+	fs.DurationVar(&conf.IdleConnTimeout, "idle-conn-timeout", conf.IdleConnTimeout,
+		"`duration` an idle connection is kept for reuse; 0 is forever")
+	fs.BoolVar(&conf.DisableKeepAlives, "disable-keep-alives", conf.DisableKeepAlives,
+		"open a new connection for every request, e.g. to test a proxy that breaks connection reuse")
+	fs.StringVar(&conf.HTTPVersion, "http-version", conf.HTTPVersion,
+		"`version` of HTTP to use: 1.1, 2, or auto; some proxies break HTTP/2")
+	fs.StringVar(&conf.IPVersion, "ip-version", conf.IPVersion,
+		"`version` of IP to connect over: 4, 6, or auto")
+	fs.StringVar(&conf.CABundle, "ca-cert", conf.CABundle,
+		"`path` to a PEM bundle of extra CA certificates to trust (env GCP_CA_BUNDLE)")
+	fs.StringVar(&conf.Emulator, "emulator", conf.Emulator,
+		"`URL` of a mock server to send every API request to instead of Google; results say nothing about reaching Google")
+	fs.BoolVar(&conf.FakeToken, "fake-token", conf.FakeToken,
+		"skip authenticating and send a fake access token, e.g. to an -emulator")
+	fs.BoolVar(&conf.Insecure, "insecure", conf.Insecure,
+		"skip TLS certificate verification; also requires GCP_ALLOW_INSECURE=1")
+	fs.BoolVar(&conf.NoTransportLogging, "no-transport-logging", conf.NoTransportLogging,
+		"don't wrap requests in the provider's logging transport, e.g. for latency benchmarks; disables request dumps")
+	fs.StringVar(&conf.UserAgentSuffix, "user-agent-suffix", conf.UserAgentSuffix,
+		"`text` appended to the User-Agent of API requests, e.g. gcp-proxy-test/ci-runner-7")
+	fs.BoolVar(&conf.FailFastOnHTTP, "fail-fast-on-http", conf.FailFastOnHTTP,
+		"only retry timeouts and connection errors; any HTTP response, even a 403, is final")
+	fs.Var((*listValue)(&conf.Checks), "checks",
+		"comma-separated `list` of checks to run; all checks run by default")
+	fs.IntVar(&conf.Parallel, "parallel", conf.Parallel,
+		"`number` of checks to run at once; output is still reported in order")
+	fs.StringVar(&conf.Region, "region", conf.Region,
+		"`region` whose regional endpoints to probe, e.g. us-central1 (env GOOGLE_REGION)")
+	fs.Var((*listValue)(&conf.RegionalEndpoints), "regional-endpoints",
+		"comma-separated `templates` of regional endpoint hosts to probe, with {region} replaced by -region (env GOOGLE_REGIONAL_ENDPOINTS)")
+	fs.BoolVar(&conf.CheckEnabled, "check-enabled", conf.CheckEnabled,
+		"check each API is enabled on the project with Service Usage first, skipping its check if not")
+	fs.StringVar(&conf.OrgID, "org-id", conf.OrgID,
+		"organizations/ID of an organization for the org check to read (env GOOGLE_ORG_ID)")
+	fs.StringVar(&conf.OrgFilter, "org-filter", conf.OrgFilter,
+		"`filter` for the organization search, e.g. domain:example.com; the org check fails if nothing matches (env GOOGLE_ORG_FILTER)")
+	fs.StringVar(&conf.ProbeURL, "probe-url", conf.ProbeURL,
+		"`URL` of any Google API method to send an authenticated GET to, e.g. https://bigquery.googleapis.com/bigquery/v2/projects/my-project/datasets")
+	fs.BoolVar(&conf.ProbeAnyHost, "probe-any-host", conf.ProbeAnyHost,
+		"allow a -probe-url outside the universe domain or over plain HTTP; the access token is sent to it")
+	fs.StringVar(&conf.FolderParent, "folder-parent", conf.FolderParent,
+		"organizations/ID or folders/ID to list folders under (env GOOGLE_FOLDER_PARENT)")
+	fs.BoolVar(&conf.FullList, "full-list", conf.FullList,
+		"page through every billing account and organization, reporting the totals")
+	fs.IntVar(&conf.MaxPages, "max-pages", conf.MaxPages,
+		"maximum `number` of pages to fetch per check with -full-list")
+	fs.Var((*listValue)(&conf.Projects), "projects",
+		"comma-separated `list` of projects to run the project checks against, comparing the results (env GOOGLE_PROJECTS)")
+	fs.Var((*listValue)(&conf.Permissions), "permissions",
+		"comma-separated `list` of IAM permissions to test on the project (env GOOGLE_PERMISSIONS)")
+	fs.IntVar(&conf.Attempts, "attempts", conf.Attempts,
+		"`number` of times to run each check, stopping at the first failure unless -fail-threshold is set")
+	fs.IntVar(&conf.FailThreshold, "fail-threshold", conf.FailThreshold,
+		"`number` of the -attempts of each check that must succeed for it to pass; 0 means all of them")
+	fs.DurationVar(&conf.RefreshWait, "refresh-wait", conf.RefreshWait,
+		"`duration` -verify-refresh waits before treating the first token as expired")
+	fs.DurationVar(&conf.Deadline, "deadline", conf.Deadline,
+		"maximum `duration` of the whole run; checks not finished by then are reported as timed out")
+	fs.DurationVar(&conf.MaxClockSkew, "max-clock-skew", conf.MaxClockSkew,
+		"maximum `duration` the local clock may be off from Google's before the clock check fails")
+	fs.DurationVar(&conf.MaxLatency, "max-latency", conf.MaxLatency,
+		"fail any attempt of a check that takes longer than this `duration`, even if it succeeded")
+	fs.DurationVar(&conf.RequestTimeout, "request-timeout", conf.RequestTimeout,
+		"maximum `duration` of each individual request (env GCP_REQUEST_TIMEOUT)")
+	fs.DurationVar(&conf.ConnectTimeout, "connect-timeout", conf.ConnectTimeout,
+		"maximum `duration` of establishing each TCP connection, to Google or a proxy (env GCP_CONNECT_TIMEOUT)")
+	fs.Int64Var(&conf.MaxResponseSize, "max-response-size", conf.MaxResponseSize,
+		"maximum size in `bytes` of a response body before it's treated as a proxy or captive portal page; 0 means no limit")
+	for _, name := range proxytest.CheckNames() {
+		fs.Var(&checkTimeoutValue{timeouts: &conf.CheckTimeouts, check: name}, "timeout-"+name,
+			fmt.Sprintf("maximum `duration` of each call of the %s check, instead of -request-timeout", name))
+	}
+	fs.StringVar(&conf.OTelEndpoint, "otel-endpoint", conf.OTelEndpoint,
+		"`URL` of an OpenTelemetry collector, e.g. http://localhost:4318, to export a span per call of each check to over OTLP/HTTP")
+	fs.IntVar(&conf.RetryMaxAttempts, "retry-max-attempts", conf.RetryMaxAttempts,
+		"maximum `number` of calls per attempt when requests fail with a retryable error")
+	fs.Var((*intListValue)(&conf.RetryOn), "retry-on",
+		"comma-separated `codes` of HTTP statuses to retry, instead of 429, 500, 502, and 503")
+	fs.DurationVar(&conf.RetryBaseDelay, "retry-base-delay", conf.RetryBaseDelay,
+		"`duration` to wait before the first retry; doubles with each further retry")
+}
+
+// configFileFlag returns the value of the -config flag in args, without
+// reporting any errors; those are reported when args are parsed for real.
+func configFileFlag(args []string) string {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var conf proxytest.Config
+	var opts options
+	bindFlags(fs, &conf, &opts)
+	fs.Parse(args)
+	return opts.configFile
+}
+
+// listValue is a flag.Value for comma-separated lists.
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = proxytest.SplitList(s)
+	return nil
+}
+
+// intListValue is a flag.Value for comma-separated lists of integers.
+type intListValue []int
+
+func (l *intListValue) String() string {
+	var s []string
+	for _, n := range *l {
+		s = append(s, strconv.Itoa(n))
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *intListValue) Set(s string) error {
+	var list []int
+	for _, v := range proxytest.SplitList(s) {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", v)
+		}
+		list = append(list, n)
+	}
+	*l = list
+	return nil
+}
+
+// exitCodeMapValue is a flag.Value for category=code pairs, each overriding
+// the exit code for that category.
+type exitCodeMapValue map[string]int
+
+func (m exitCodeMapValue) String() string {
+	var pairs []string
+	for _, category := range proxytest.Categories() {
+		if code, ok := m[category]; ok {
+			pairs = append(pairs, fmt.Sprintf("%s=%d", category, code))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m exitCodeMapValue) Set(s string) error {
+	for _, pair := range proxytest.SplitList(s) {
+		category, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("%q is not a category=code pair", pair)
+		}
+		if !slices.Contains(proxytest.Categories(), category) {
+			return fmt.Errorf("unknown category %q; valid categories are %s", category, strings.Join(proxytest.Categories(), ", "))
+		}
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 2 || code > 125 {
+			return fmt.Errorf("exit code %q for %s must be a number from 2 to 125; 0 and 1 mean success and a config error", v, category)
+		}
+		m[category] = code
+	}
+	return nil
+}
+
+// checkTimeoutValue is a flag.Value for the timeout of a single check.
+type checkTimeoutValue struct {
+	timeouts *map[string]time.Duration
+	check    string
+}
+
+func (v *checkTimeoutValue) String() string {
+	if v.timeouts == nil {
+		return ""
+	}
+	if d, ok := (*v.timeouts)[v.check]; ok {
+		return d.String()
+	}
+	return ""
+}
+
+func (v *checkTimeoutValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if *v.timeouts == nil {
+		*v.timeouts = make(map[string]time.Duration)
+	}
+	(*v.timeouts)[v.check] = d
+	return nil
+}
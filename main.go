@@ -2,161 +2,256 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
 	"log"
-	"net/http"
 	"os"
-	"time"
-
-	"github.com/hashicorp/terraform/helper/logging"
-	"github.com/hashicorp/terraform/helper/pathorcontents"
-	"github.com/hashicorp/terraform/httpclient"
-	"github.com/terraform-providers/terraform-provider-google/version"
-	"golang.org/x/oauth2"
-	googleoauth "golang.org/x/oauth2/google"
-	"google.golang.org/api/cloudbilling/v1"
-	"google.golang.org/api/cloudresourcemanager/v1"
+	"os/signal"
+	"syscall"
+
+	"github.com/paddycarver/gcp-proxy-test/proxytest"
+)
+
+const (
+	// exitOK means the config loaded and every probe succeeded.
+	exitOK = 0
+	// exitConfigError means the flags, config, or credentials couldn't be
+	// loaded, so no probes were run.
+	exitConfigError = 1
+	// exitCheckFailed means the config loaded, but at least one probe
+	// failed: for a reason without its own code in exitCodes, or in a mode
+	// that compares several runs or repeats them, which aren't classified.
+	exitCheckFailed = 6
 )
 
+// defaultExitCodes are the exit codes of runs that failed, by the category
+// that best explains the failure; see proxytest.Report.FailureCategory.
+// They can be overridden with -exit-code-map.
+var defaultExitCodes = map[string]int{
+	proxytest.CategoryAuthentication: 2,
+	proxytest.CategoryNetwork:        3,
+	proxytest.CategoryAuthorization:  4,
+	proxytest.CategoryQuota:          5,
+}
+
+// exitCode returns the exit code for a run that produced report: exitOK if
+// it passed, and otherwise the code in codes for the category of its
+// failure, or exitCheckFailed if it has none.
+func exitCode(report proxytest.Report, codes map[string]int) int {
+	if report.Success {
+		return exitOK
+	}
+	if code, ok := codes[report.FailureCategory()]; ok {
+		return code
+	}
+	return exitCheckFailed
+}
+
 func main() {
-	conf := configFromEnv()
-	err := conf.LoadAndValidate()
+	// Only results are written to stdout, so they can be piped to other
+	// tools, e.g. jq with -output json. Everything else, including flag
+	// usage and logs written before the log level is known, goes to stderr.
+	log.SetOutput(os.Stderr)
+	flag.CommandLine.SetOutput(os.Stderr)
+
+	var opts options
+	// Settings come from, in increasing order of precedence: the config
+	// file, the environment, and flags. The config file's path is itself a
+	// flag, so look for it before anything else is read.
+	conf := proxytest.DefaultConfig()
+	if path := configFileFlag(os.Args[1:]); path != "" {
+		if err := proxytest.LoadConfigFile(path, &conf); err != nil {
+			log.Printf("[ERROR] Error reading config file: %s", err)
+			os.Exit(exitConfigError)
+		}
+	}
+	conf, err := proxytest.ConfigFromEnv(conf)
 	if err != nil {
-		log.Println("Error loading and validating config:", err)
-		os.Exit(1)
+		log.Printf("[ERROR] Error reading config from environment: %s", err)
+		os.Exit(exitConfigError)
+	}
+	bindFlags(flag.CommandLine, &conf, &opts)
+	flag.Parse()
+	if err := proxytest.SetLogOutput(opts.debug, opts.logLevel, opts.logFormat); err != nil {
+		log.Printf("[ERROR] %s", err)
+		os.Exit(exitConfigError)
 	}
-	fmt.Println("Config successfully loaded ✅")
 
-	fmt.Print("Trying billing API... ")
-	for i := 0; i < 5; i++ {
-		_, err := conf.clientBilling.BillingAccounts.List().Do()
-		if err != nil {
-			fmt.Print("‼️  Error listing cloud billing accounts: " + err.Error())
-			break
+	if opts.version {
+		proxytest.PrintVersion(os.Stdout)
+		os.Exit(exitOK)
+	}
+	if opts.listChecks {
+		if err := proxytest.ListChecks(os.Stdout, opts.output); err != nil {
+			log.Printf("[ERROR] Error writing checks: %s", err)
+			os.Exit(exitConfigError)
 		}
-		fmt.Print("✅")
+		os.Exit(exitOK)
 	}
-	fmt.Println("")
-
-	fmt.Print("Trying org API... ")
-	for i := 0; i < 5; i++ {
-		_, err := conf.clientResourceManager.Organizations.Search(&cloudresourcemanager.SearchOrganizationsRequest{}).Do()
-		if err != nil {
-			fmt.Print("‼️  Error listing organizations: " + err.Error())
-			break
+	if opts.dumpEnv {
+		if err := proxytest.DumpEnv(os.Stdout, opts.output, os.Environ()); err != nil {
+			log.Printf("[ERROR] Error writing environment: %s", err)
+			os.Exit(exitConfigError)
 		}
-		fmt.Print("✅")
+		os.Exit(exitOK)
 	}
-	fmt.Println("")
-}
-
-type Config struct {
-	Credentials string
-	AccessToken string
-	Scopes      []string
-
-	client    *http.Client
-	userAgent string
-
-	tokenSource oauth2.TokenSource
 
-	clientBilling         *cloudbilling.APIService
-	clientResourceManager *cloudresourcemanager.Service
-}
+	if opts.tokenStdin {
+		if err := conf.ReadTokenStdin(os.Stdin, opts.credentialsList); err != nil {
+			log.Printf("[ERROR] %s", err)
+			os.Exit(exitConfigError)
+		}
+	}
 
-func configFromEnv() Config {
-	var conf Config
-	conf.Credentials = os.Getenv("GOOGLE_CREDENTIALS")
-	if conf.Credentials == "" {
-		conf.Credentials = os.Getenv("GOOGLE_CLOUD_KEYFILE_JSON")
+	// Color is only used on terminals, and never if NO_COLOR is set, per
+	// https://no-color.org.
+	color := !opts.noColor && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+	out, err := proxytest.NewReporter(opts.output, os.Stdout, color)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		os.Exit(exitConfigError)
 	}
-	if conf.Credentials == "" {
-		conf.Credentials = os.Getenv("GOOGLE_KEYFILE_JSON")
+	if opts.quiet {
+		out = proxytest.NewQuietReporter(os.Stdout)
 	}
-	conf.AccessToken = os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
-	return conf
-}
 
-var defaultClientScopes = []string{
-	"https://www.googleapis.com/auth/compute",
-	"https://www.googleapis.com/auth/cloud-platform",
-	"https://www.googleapis.com/auth/ndev.clouddns.readwrite",
-	"https://www.googleapis.com/auth/devstorage.full_control",
-}
+	// Long-running modes stream JSON Lines as results come, alongside
+	// their usual output.
+	var stream proxytest.Reporter
+	if opts.output == proxytest.OutputJSONL {
+		stream = out
+	}
 
-func (c *Config) LoadAndValidate() error {
-	if len(c.Scopes) == 0 {
-		c.Scopes = defaultClientScopes
+	// Ctrl-C cancels in-flight requests, and the rest of the run is reported
+	// as interrupted. A second Ctrl-C exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if len(opts.credentialsList) > 0 {
+		success, err := proxytest.CompareCredentials(ctx, conf, opts.credentialsList, out)
+		if err != nil {
+			log.Printf("[ERROR] Error writing results: %s", err)
+			os.Exit(exitCheckFailed)
+		}
+		if !success {
+			os.Exit(exitCheckFailed)
+		}
+		os.Exit(exitOK)
 	}
 
-	tokenSource, err := c.getTokenSource(c.Scopes)
+	err = conf.LoadAndValidate()
 	if err != nil {
-		return err
+		log.Printf("[ERROR] Error loading and validating config: %s", err)
+		os.Exit(exitConfigError)
 	}
-	c.tokenSource = tokenSource
+	out.ConfigLoaded()
 
-	client := oauth2.NewClient(context.Background(), tokenSource)
-	client.Transport = logging.NewTransport("Google", client.Transport)
-	// Each individual request should return within 30s - timeouts will be retried.
-	// This is a timeout for, e.g. a single GET request of an operation - not a
-	// timeout for the maximum amount of time a logical request can take.
-	client.Timeout, _ = time.ParseDuration("30s")
+	if opts.validateOnly {
+		if err := proxytest.PrintValidation(os.Stdout, opts.output, &conf); err != nil {
+			log.Printf("[ERROR] Error writing results: %s", err)
+			os.Exit(exitConfigError)
+		}
+		os.Exit(exitOK)
+	}
 
-	terraformVersion := httpclient.UserAgentString()
-	providerVersion := fmt.Sprintf("terraform-provider-google/%s", version.ProviderVersion)
-	terraformWebsite := "(+https://www.terraform.io)"
-	userAgent := fmt.Sprintf("%s %s %s", terraformVersion, terraformWebsite, providerVersion)
+	if opts.printConfig {
+		if err := proxytest.PrintConfig(os.Stdout, opts.output, &conf); err != nil {
+			log.Printf("[ERROR] Error writing config: %s", err)
+			os.Exit(exitConfigError)
+		}
+		os.Exit(exitOK)
+	}
 
-	c.client = client
-	c.userAgent = userAgent
+	if opts.showCertChain {
+		success, err := conf.ShowCertChains(ctx, os.Stdout, opts.output)
+		if err != nil {
+			log.Printf("[ERROR] Error writing results: %s", err)
+			os.Exit(exitCheckFailed)
+		}
+		if !success {
+			os.Exit(exitCheckFailed)
+		}
+		os.Exit(exitOK)
+	}
 
-	log.Printf("[INFO] Instantiating Google Cloud ResourceManager Client...")
-	c.clientResourceManager, err = cloudresourcemanager.New(client)
-	if err != nil {
-		return err
+	if opts.bundleOut != "" {
+		report, err := conf.WriteBundle(ctx, opts.bundleOut, out)
+		if err != nil {
+			log.Printf("[ERROR] %s", err)
+			os.Exit(exitCheckFailed)
+		}
+		if err := out.Finish(report); err != nil {
+			log.Printf("[ERROR] Error writing results: %s", err)
+			os.Exit(exitCheckFailed)
+		}
+		os.Exit(exitCode(report, opts.exitCodes))
 	}
-	c.clientResourceManager.UserAgent = userAgent
 
-	log.Printf("[INFO] Instantiating Google Cloud Billing Client...")
-	c.clientBilling, err = cloudbilling.New(client)
-	if err != nil {
-		return err
+	if opts.verifyRefresh {
+		report := conf.VerifyRefresh(ctx, out)
+		if err := out.Finish(report); err != nil {
+			log.Printf("[ERROR] Error writing results: %s", err)
+			os.Exit(exitCheckFailed)
+		}
+		os.Exit(exitCode(report, opts.exitCodes))
 	}
-	c.clientBilling.UserAgent = userAgent
 
-	return nil
-}
+	if opts.serve != "" {
+		if err := conf.Serve(ctx, opts.serve, opts.serveInterval, stream); err != nil {
+			log.Printf("[ERROR] Error serving metrics: %s", err)
+			os.Exit(exitConfigError)
+		}
+		os.Exit(exitOK)
+	}
 
-func (c *Config) getTokenSource(clientScopes []string) (oauth2.TokenSource, error) {
-	if c.AccessToken != "" {
-		contents, _, err := pathorcontents.Read(c.AccessToken)
+	if opts.stress > 0 {
+		success, err := conf.Stress(ctx, os.Stdout, opts.output, opts.stress, opts.stressRate, opts.stressConcurrency)
 		if err != nil {
-			return nil, fmt.Errorf("Error loading access token: %s", err)
+			log.Printf("[ERROR] Error stress testing: %s", err)
+			os.Exit(exitConfigError)
 		}
-
-		log.Printf("[INFO] Authenticating using configured Google JSON 'access_token'...")
-		log.Printf("[INFO]   -- Scopes: %s", clientScopes)
-		token := &oauth2.Token{AccessToken: contents}
-		return oauth2.StaticTokenSource(token), nil
+		if !success {
+			os.Exit(exitCheckFailed)
+		}
+		os.Exit(exitOK)
 	}
 
-	if c.Credentials != "" {
-		contents, _, err := pathorcontents.Read(c.Credentials)
+	if opts.watch > 0 {
+		success, err := conf.Watch(ctx, os.Stdout, opts.watch, color, stream)
 		if err != nil {
-			return nil, fmt.Errorf("Error loading credentials: %s", err)
+			log.Printf("[ERROR] Error watching: %s", err)
+			os.Exit(exitConfigError)
 		}
+		if !success {
+			os.Exit(exitCheckFailed)
+		}
+		os.Exit(exitOK)
+	}
 
-		creds, err := googleoauth.CredentialsFromJSON(context.Background(), []byte(contents), clientScopes...)
+	if len(conf.Projects) > 0 {
+		success, err := proxytest.CompareProjects(ctx, &conf, out)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to parse credentials from '%s': %s", contents, err)
+			log.Printf("[ERROR] Error checking each project: %s", err)
+			os.Exit(exitCheckFailed)
 		}
+		if !success {
+			os.Exit(exitCheckFailed)
+		}
+		os.Exit(exitOK)
+	}
 
-		log.Printf("[INFO] Authenticating using configured Google JSON 'credentials'...")
-		log.Printf("[INFO]   -- Scopes: %s", clientScopes)
-		return creds.TokenSource, nil
+	report := conf.RunChecks(ctx, out)
+	if err := out.Finish(report); err != nil {
+		log.Printf("[ERROR] Error writing results: %s", err)
+		os.Exit(exitCheckFailed)
 	}
+	os.Exit(exitCode(report, opts.exitCodes))
+}
 
-	log.Printf("[INFO] Authenticating using DefaultClient...")
-	log.Printf("[INFO]   -- Scopes: %s", clientScopes)
-	return googleoauth.DefaultTokenSource(context.Background(), clientScopes...)
+// isTerminal reports whether f is a terminal, rather than e.g. a pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
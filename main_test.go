@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// TestMain runs main instead of the tests when GCP_PROXY_TEST_RUN_MAIN is
+// set, so tests can run the tool as a separate process and capture its
+// output.
+func TestMain(m *testing.M) {
+	if os.Getenv("GCP_PROXY_TEST_RUN_MAIN") == "1" {
+		os.Args = append([]string{"gcp-proxy-test"}, os.Args[1:]...)
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the tool with args, returning what it wrote to stdout and
+// stderr, and its exit code.
+func runMain(t *testing.T, args ...string) (stdout, stderr []byte, code int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "GCP_PROXY_TEST_RUN_MAIN=1")
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("running %v: %s", args, err)
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), cmd.ProcessState.ExitCode()
+}
+
+func TestOutputJSONOnlyWritesJSONToStdout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/v1/projects/my-project" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"error": {"code": 404, "message": "not found"}}`)
+			return
+		}
+		io.WriteString(w, `{"projectId": "my-project", "lifecycleState": "ACTIVE"}`)
+	}))
+	defer srv.Close()
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "ya29.test")
+	t.Setenv("GOOGLE_PROJECT", "my-project")
+	t.Setenv("GOOGLE_RESOURCE_MANAGER_CUSTOM_ENDPOINT", srv.URL)
+	t.Setenv("GOOGLE_BILLING_CUSTOM_ENDPOINT", srv.URL)
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+	}{
+		{"passing", []string{"-checks", "project"}, exitOK},
+		{"failing with debug logs", []string{"-checks", "project,billing", "-debug"}, exitCheckFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"-attempts", "1", "-retry-max-attempts", "1", "-output", "json"}, tt.args...)
+			stdout, stderr, code := runMain(t, args...)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d; stderr:\n%s", code, tt.wantCode, stderr)
+			}
+			if len(stderr) == 0 {
+				t.Error("nothing was logged to stderr")
+			}
+
+			dec := json.NewDecoder(bytes.NewReader(stdout))
+			var report struct {
+				Success *bool             `json:"success"`
+				Results []json.RawMessage `json:"results"`
+			}
+			if err := dec.Decode(&report); err != nil {
+				t.Fatalf("stdout isn't JSON: %s\n%s", err, stdout)
+			}
+			if _, err := dec.Token(); err != io.EOF {
+				t.Errorf("stdout has more than one JSON value:\n%s", stdout)
+			}
+			if report.Success == nil || len(report.Results) == 0 {
+				t.Errorf("stdout isn't a report:\n%s", stdout)
+			}
+		})
+	}
+}
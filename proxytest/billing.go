@@ -0,0 +1,57 @@
+package proxytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/cloudbilling/v1"
+)
+
+// checkBilling lists the billing accounts visible to the credentials. With
+// c.FullList, it pages through them all and reports how many there are.
+func checkBilling(ctx context.Context, c *Config) (string, error) {
+	if c.FullList {
+		var n, pages int
+		err := c.clientBilling.BillingAccounts.List().Pages(ctx, func(resp *cloudbilling.ListBillingAccountsResponse) error {
+			n += len(resp.BillingAccounts)
+			pages++
+			if pages >= c.MaxPages && resp.NextPageToken != "" {
+				return errPageLimit
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errPageLimit) {
+			return "", fmt.Errorf("Error listing cloud billing accounts: %w", err)
+		}
+		return c.pageCount(n, pages, "billing accounts", err != nil), nil
+	}
+
+	_, err := c.clientBilling.BillingAccounts.List().Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Error listing cloud billing accounts: %w", err)
+	}
+	return "", nil
+}
+
+// checkBillingLink reads the billing info of the configured project and
+// reports which account it's linked to, the step before linking it to a new
+// one. Nothing is modified.
+func checkBillingLink(ctx context.Context, c *Config) (string, error) {
+	if c.Project == "" || c.BillingAccount == "" {
+		return "", skip("needs both GOOGLE_PROJECT and GOOGLE_BILLING_ACCOUNT")
+	}
+	info, err := c.clientBilling.Projects.GetBillingInfo("projects/" + c.Project).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Error reading billing info for project %q: %w", c.Project, err)
+	}
+	if !info.BillingEnabled {
+		return fmt.Sprintf("billing is not enabled for project %q", c.Project), nil
+	}
+	linked := strings.TrimPrefix(info.BillingAccountName, "billingAccounts/")
+	if linked != strings.TrimPrefix(c.BillingAccount, "billingAccounts/") {
+		return fmt.Sprintf("project %q is linked to billing account %s, not %s", c.Project, linked, c.BillingAccount), nil
+	}
+	return fmt.Sprintf("project %q is linked to billing account %s", c.Project, linked), nil
+}
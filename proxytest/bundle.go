@@ -0,0 +1,114 @@
+package proxytest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// WriteBundle runs every check, reporting results to out as usual, then
+// writes a gzipped tarball to path for attaching to issues. It holds:
+//
+//	env.txt      the environment, as printed by -dump-env
+//	dns.json     the resolution of every endpoint host
+//	probes.json  the full report of the run, including timings
+//	certs.pem    the certificate chain each endpoint host presented
+//
+// Every file has the configured secrets redacted. It returns the report.
+func (c *Config) WriteBundle(ctx context.Context, path string, out Reporter) (Report, error) {
+	report := c.RunChecks(ctx, out)
+
+	var env bytes.Buffer
+	if err := DumpEnv(&env, OutputText, os.Environ()); err != nil {
+		return report, err
+	}
+	dns, err := json.MarshalIndent(c.resolveHosts(ctx), "", "  ")
+	if err != nil {
+		return report, err
+	}
+	probes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return report, err
+	}
+	var certs bytes.Buffer
+	chains, _ := c.certChains(ctx)
+	for _, hc := range chains {
+		fmt.Fprintf(&certs, "# %s\n", hc.Host)
+		if hc.Error != "" {
+			fmt.Fprintf(&certs, "# error: %s\n", hc.Error)
+		}
+		for _, cert := range hc.certs {
+			fmt.Fprintf(&certs, "# subject: %s\n# issuer: %s\n", cert.Subject, cert.Issuer)
+			pem.Encode(&certs, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return report, fmt.Errorf("Error creating bundle: %s", err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range []struct {
+		name     string
+		contents []byte
+	}{
+		{"env.txt", env.Bytes()},
+		{"dns.json", dns},
+		{"probes.json", probes},
+		{"certs.pem", certs.Bytes()},
+	} {
+		contents := c.redactSecrets(file.contents)
+		hdr := &tar.Header{Name: file.name, Mode: 0600, Size: int64(len(contents)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return report, fmt.Errorf("Error writing bundle: %s", err)
+		}
+		if _, err := tw.Write(contents); err != nil {
+			return report, fmt.Errorf("Error writing bundle: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return report, fmt.Errorf("Error writing bundle: %s", err)
+	}
+	if err := gz.Close(); err != nil {
+		return report, fmt.Errorf("Error writing bundle: %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return report, fmt.Errorf("Error writing bundle: %s", err)
+	}
+	log.Printf("[INFO] Wrote support bundle to %s", path)
+	return report, nil
+}
+
+// redactSecrets masks every configured secret that appears in b: the
+// access token in use, a configured access token, inline credentials, and
+// the proxy password.
+func (c *Config) redactSecrets(b []byte) []byte {
+	secrets := []string{c.ProxyPassword}
+	if c.token != nil {
+		secrets = append(secrets, c.token.AccessToken)
+	}
+	if c.AccessToken != "" {
+		secrets = append(secrets, c.AccessToken)
+	}
+	if strings.HasPrefix(strings.TrimSpace(c.Credentials), "{") {
+		secrets = append(secrets, c.Credentials)
+	}
+	s := string(b)
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, "<redacted>")
+		}
+	}
+	return []byte(s)
+}
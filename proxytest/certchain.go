@@ -0,0 +1,102 @@
+package proxytest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// certInfo describes a certificate presented during a TLS handshake.
+type certInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// hostChain is the certificate chain presented for a host, and the error
+// from the handshake, if any.
+type hostChain struct {
+	Host  string     `json:"host"`
+	Error string     `json:"error,omitempty"`
+	Chain []certInfo `json:"chain"`
+
+	certs []*x509.Certificate
+}
+
+// certChains completes a TLS handshake with every endpoint host, the same
+// way the tls check does, and returns the certificate chain each presented.
+// Chains are returned even when they can't be verified, since that's when
+// they matter: they show whether a proxy is intercepting TLS, and which CA
+// it uses. ok is false if any chain couldn't be verified. An emulator
+// served over plain HTTP has no chain to return.
+func (c *Config) certChains(ctx context.Context) (chains []hostChain, ok bool) {
+	ok = true
+	if c.plainEmulator() {
+		log.Printf("[INFO] Not fetching certificate chains, since the emulator at %s is served over plain HTTP", c.Emulator)
+		return nil, ok
+	}
+	for _, host := range c.endpointHosts() {
+		hc := hostChain{Host: host}
+		state, err := c.handshake(ctx, host)
+		if err != nil {
+			ok = false
+			hc.Error = err.Error()
+			var verr *tls.CertificateVerificationError
+			if errors.As(err, &verr) {
+				hc.certs = verr.UnverifiedCertificates
+			}
+		} else {
+			hc.certs = state.PeerCertificates
+		}
+		for _, cert := range hc.certs {
+			hc.Chain = append(hc.Chain, certInfo{
+				Subject:   cert.Subject.String(),
+				Issuer:    cert.Issuer.String(),
+				DNSNames:  cert.DNSNames,
+				NotBefore: cert.NotBefore,
+				NotAfter:  cert.NotAfter,
+			})
+		}
+		chains = append(chains, hc)
+	}
+	return chains, ok
+}
+
+// ShowCertChains writes the certificate chain each endpoint host presents
+// in the given output format, for -show-cert-chain. It returns whether every
+// chain was verified.
+func (c *Config) ShowCertChains(ctx context.Context, w io.Writer, format string) (bool, error) {
+	chains, success := c.certChains(ctx)
+
+	if format == OutputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return success, enc.Encode(chains)
+	}
+
+	for _, hc := range chains {
+		fmt.Fprintf(w, "\n=== %s ===\n", hc.Host)
+		if hc.Error != "" {
+			fmt.Fprintf(w, "‼️  %s\n", hc.Error)
+		}
+		for i, cert := range hc.Chain {
+			fmt.Fprintf(w, "%d. Subject: %s\n", i, cert.Subject)
+			fmt.Fprintf(w, "   Issuer:  %s\n", cert.Issuer)
+			if len(cert.DNSNames) > 0 {
+				fmt.Fprintf(w, "   SANs:    %s\n", strings.Join(cert.DNSNames, ", "))
+			}
+			fmt.Fprintf(w, "   Valid:   %s to %s\n", cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return success, nil
+}
@@ -0,0 +1,510 @@
+package proxytest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// check is a probe of a single API that can be selected with --checks. The
+// built-in checks are checks; those added with Register are wrapped in one.
+type check struct {
+	// name selects the check with --checks, and identifies its results.
+	name string
+	// label describes the check in text output.
+	label string
+	// run makes a single call against the API, returning an optional
+	// description of what it found.
+	run func(ctx context.Context, c *Config) (string, error)
+	// project is set for checks of the configured project, which are run
+	// for each project when several are configured.
+	project bool
+	// service is the API the check calls, which must be enabled on the
+	// project, if any.
+	service string
+
+	// description says what the check does, and requires what it needs to
+	// run, for -list-checks.
+	description string
+	requires    []string
+}
+
+// checks are all the registered checks, in the order they run and are
+// reported in.
+var checks = []check{
+	{
+		name: "identity", label: "token identity", run: checkIdentity,
+		description: "asks Google who the token belongs to",
+	},
+	{
+		name: "resolve", label: "DNS resolution", run: checkResolve,
+		description: "resolves the host of every API and token endpoint",
+	},
+	{
+		name: "connect", label: "proxy CONNECT", run: checkConnect,
+		description: "asks the proxy to CONNECT to every API host, reporting its response",
+		requires:    []string{"an HTTP(S) proxy"},
+	},
+	{
+		name: "tls", label: "TCP/TLS connectivity", run: checkTLS,
+		description: "completes a TLS handshake with every API host, reporting the certificate issuer",
+	},
+	{
+		name: "regional", label: "regional endpoints", run: checkRegional,
+		description: "sends a request to every regional endpoint, reporting whether each is reachable",
+		requires:    []string{"GOOGLE_REGION"},
+	},
+	{
+		name: "token", label: "token endpoint", run: checkToken,
+		description: "sends an unauthenticated request to the token endpoint, reporting whether it's reachable apart from any API",
+	},
+	{
+		name: "clock", label: "clock skew", run: checkClock,
+		description: "compares the local clock to the Date header of the token endpoint, failing if it's off by more than -max-clock-skew",
+	},
+	{
+		name: "metadata", label: "metadata server", run: checkMetadata,
+		description: "reads the default service account and a token from the metadata server",
+		requires:    []string{"running on GCP"},
+	},
+	{
+		name: "billing", label: "billing API", run: checkBilling, service: "cloudbilling.googleapis.com",
+		description: "lists billing accounts",
+	},
+	{
+		name: "billing-link", label: "project billing info", run: checkBillingLink, project: true, service: "cloudbilling.googleapis.com",
+		description: "reads which billing account the project is linked to",
+		requires:    []string{"GOOGLE_PROJECT", "GOOGLE_BILLING_ACCOUNT"},
+	},
+	{
+		name: "org", label: "org API", run: checkOrg, service: "cloudresourcemanager.googleapis.com",
+		description: "reads GOOGLE_ORG_ID if it's set, or else searches organizations, only those matching GOOGLE_ORG_FILTER if that's set",
+	},
+	{
+		name: "folders", label: "folders API", run: checkFolders, service: "cloudresourcemanager.googleapis.com",
+		description: "lists the folders under an organization or folder",
+		requires:    []string{"GOOGLE_FOLDER_PARENT"},
+	},
+	{
+		name: "projects", label: "projects API", run: checkProjects, service: "cloudresourcemanager.googleapis.com",
+		description: "lists projects",
+	},
+	{
+		name: "project", label: "configured project", run: checkProject, project: true, service: "cloudresourcemanager.googleapis.com",
+		description: "reads the project, reporting its lifecycle state and parent",
+		requires:    []string{"GOOGLE_PROJECT"},
+	},
+	{
+		name: "permissions", label: "IAM permissions", run: checkPermissions, project: true, service: "cloudresourcemanager.googleapis.com",
+		description: "tests which of GOOGLE_PERMISSIONS are granted on the project",
+		requires:    []string{"GOOGLE_PROJECT"},
+	},
+	{
+		name: "compute", label: "compute API", run: checkCompute, project: true, service: "compute.googleapis.com",
+		description: "lists compute zones in the project",
+		requires:    []string{"GOOGLE_PROJECT"},
+	},
+	{
+		name: "storage", label: "storage API", run: checkStorage, project: true, service: "storage.googleapis.com",
+		description: "lists storage buckets in the project",
+		requires:    []string{"GOOGLE_PROJECT"},
+	},
+	{
+		name: "dns", label: "DNS API", run: checkDNS, project: true, service: "dns.googleapis.com",
+		description: "lists Cloud DNS managed zones in the project",
+		requires:    []string{"GOOGLE_PROJECT"},
+	},
+	{
+		name: "probe-url", label: "probe URL", run: checkProbeURL,
+		description: "sends an authenticated GET to the -probe-url, summarizing the response",
+		requires:    []string{"-probe-url"},
+	},
+}
+
+// ListChecks writes every registered check, with what it does and needs,
+// in the given output format, for -list-checks.
+func ListChecks(w io.Writer, format string) error {
+	if format == OutputJSON {
+		type entry struct {
+			Name        string   `json:"name"`
+			Description string   `json:"description"`
+			Requires    []string `json:"requires"`
+			Project     bool     `json:"project"`
+		}
+		entries := []entry{}
+		for _, chk := range checks {
+			requires := chk.requires
+			if requires == nil {
+				requires = []string{}
+			}
+			entries = append(entries, entry{chk.name, chk.description, requires, chk.project})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(entries)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "check\trequires\tdescription")
+	for _, chk := range checks {
+		requires := strings.Join(chk.requires, ", ")
+		if requires == "" {
+			requires = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", chk.name, requires, chk.description)
+	}
+	return tw.Flush()
+}
+
+// skipError is returned by a check that can't run with the current config,
+// e.g. because it needs a project and none is set.
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	return e.reason
+}
+
+// skip returns a skipError with a formatted reason.
+func skip(format string, a ...interface{}) error {
+	return &skipError{reason: fmt.Sprintf(format, a...)}
+}
+
+// defaultMaxPages limits how many pages a check fetches with -full-list,
+// in case listing never ends.
+const defaultMaxPages = 10
+
+// errPageLimit stops paging once MaxPages pages have been fetched.
+var errPageLimit = errors.New("page limit reached")
+
+// pageCount describes having counted n items of the given kind across
+// pages pages, noting if paging stopped at the limit with more to fetch.
+func (c *Config) pageCount(n, pages int, kind string, limited bool) string {
+	detail := fmt.Sprintf("%d %s across %d pages", n, kind, pages)
+	if limited {
+		detail += fmt.Sprintf(", stopped at the limit of %d pages", c.MaxPages)
+	}
+	return detail
+}
+
+// describeFailure explains whether err came from Google or the network: any
+// HTTP response, even a 403, shows the request got through the proxy.
+func describeFailure(err error) string {
+	if status := httpStatus(err); status != 0 {
+		return fmt.Sprintf("[HTTP %d response: the request reached Google]", status)
+	}
+	if isNetworkError(err) {
+		return "[no HTTP response: the network or proxy dropped the request]"
+	}
+	return ""
+}
+
+// lookupCheck returns the registered check called name.
+func lookupCheck(name string) (check, bool) {
+	for _, chk := range checks {
+		if chk.name == name {
+			return chk, true
+		}
+	}
+	return check{}, false
+}
+
+// CheckNames returns the name of every check, in the order they run.
+func CheckNames() []string {
+	var names []string
+	for _, chk := range checks {
+		names = append(names, chk.name)
+	}
+	return names
+}
+
+// validateChecks returns an error if any of names isn't a registered check.
+func validateChecks(names []string) error {
+	for _, name := range names {
+		if _, ok := lookupCheck(name); !ok {
+			var valid []string
+			for _, chk := range checks {
+				valid = append(valid, chk.name)
+			}
+			return fmt.Errorf("Unknown check %q; valid checks are %s", name, strings.Join(valid, ", "))
+		}
+	}
+	return nil
+}
+
+// selected reports whether the check called name should run. All checks run
+// unless specific checks were selected.
+func (c *Config) selected(name string) bool {
+	if len(c.Checks) == 0 {
+		return true
+	}
+	for _, n := range c.Checks {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RunChecks runs every selected check, reporting results in order as they
+// complete. With c.Parallel above one, that many checks run at once; each
+// check's output is buffered until the checks before it have been reported,
+// so the output is the same as a sequential run. With c.Deadline set, checks
+// still running when it passes are cut short. c must have been loaded with
+// LoadAndValidate; if out is nil, nothing is reported as the run progresses.
+func (c *Config) RunChecks(ctx context.Context, out Reporter) Report {
+	if out == nil {
+		out = &quietReporter{w: io.Discard}
+	}
+	if c.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Deadline)
+		defer cancel()
+	}
+
+	// Connections are counted per run, so only this run's reuse is reported.
+	c.conns.take()
+
+	results := make([][]Result, len(checks))
+	if c.Parallel <= 1 {
+		for i, chk := range checks {
+			results[i] = c.runCheck(ctx, out, chk)
+		}
+	} else {
+		recorders := make([]*recorder, len(checks))
+		done := make([]chan struct{}, len(checks))
+		for i := range done {
+			done[i] = make(chan struct{})
+		}
+
+		jobs := make(chan int)
+		for w := 0; w < c.Parallel; w++ {
+			go func() {
+				for i := range jobs {
+					recorders[i] = &recorder{}
+					results[i] = c.runCheck(ctx, recorders[i], checks[i])
+					close(done[i])
+				}
+			}()
+		}
+		go func() {
+			for i := range checks {
+				jobs <- i
+			}
+			close(jobs)
+		}()
+
+		for i := range checks {
+			<-done[i]
+			recorders[i].replay(out)
+		}
+	}
+
+	var report Report
+	for _, rs := range results {
+		report.Results = append(report.Results, rs...)
+	}
+	if c.FailThreshold > 0 {
+		report.Thresholds = summarizeThresholds(report.Results, c.FailThreshold)
+	}
+	report.Success = len(failedChecks(report)) == 0
+	report.Retries = summarizeRetries(report.Results)
+	report.Connections = c.conns.take()
+	c.warnLowReuse(report.Connections)
+	// Tokens should be minted once and reused until they expire; many mints
+	// can get the token endpoint rate limited.
+	log.Printf("[INFO] Tokens minted so far: %d", c.mints.count())
+	c.flushTraces()
+	return report
+}
+
+// warnLowReuse warns if most requests through a proxy opened a new
+// connection, which suggests the proxy closes them after every request.
+func (c *Config) warnLowReuse(counts []ConnectionReuse) {
+	var requests, reused int
+	for _, r := range counts {
+		if c.proxied(strings.Split(r.Host, ":")[0]) {
+			requests += r.Requests
+			reused += r.Reused
+		}
+	}
+	// The first request to each host always needs a new connection, so
+	// only runs with a few requests per host say much.
+	if requests >= 2*len(counts)+2 && reused*2 < requests {
+		log.Printf("[WARN] Only %d of %d requests through the proxy reused a connection; the proxy may be closing connections after each request", reused, requests)
+	}
+}
+
+// notSelected is the skip reason of checks that weren't selected.
+const notSelected = "not selected with --checks"
+
+// runCheck runs chk if it's selected, or reports it as skipped if not. Once
+// ctx is done, checks that would otherwise run are reported as interrupted
+// or timed out without running.
+func (c *Config) runCheck(ctx context.Context, out Reporter, chk check) []Result {
+	if !c.selected(chk.name) {
+		out.StartCheck(chk.label)
+		result := Result{Check: chk.name, Skipped: true, SkipReason: notSelected}
+		out.Attempt(result)
+		out.EndCheck(nil)
+		return []Result{result}
+	}
+	if reason := c.serviceDisabled(ctx, chk); reason != "" {
+		out.StartCheck(chk.label)
+		result := Result{Check: chk.name, Skipped: true, SkipReason: reason}
+		out.Attempt(result)
+		out.EndCheck(nil)
+		return []Result{result}
+	}
+	if ctx.Err() != nil {
+		out.StartCheck(chk.label)
+		result := Result{Check: chk.name, Error: "interrupted before the check ran", Category: CategoryInterrupted}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			result.Error = c.deadlinePassed("before the check ran")
+			result.Category = CategoryDeadline
+		}
+		out.Attempt(result)
+		out.EndCheck(nil)
+		return []Result{result}
+	}
+	return c.probe(ctx, out, chk)
+}
+
+// deadlinePassed describes the run's deadline passing when, e.g. "before
+// the check ran".
+func (c *Config) deadlinePassed(when string) string {
+	if c.Deadline > 0 {
+		return fmt.Sprintf("timed out: the run's deadline of %s passed %s", c.Deadline, when)
+	}
+	return "timed out: the run's deadline passed " + when
+}
+
+// serviceDisabled returns why chk shouldn't run if c.CheckEnabled is set
+// and the API it calls isn't enabled on the project, or "" if it should.
+// Calling a disabled API fails with a 403 that's easily mistaken for a
+// permissions problem. If Service Usage can't say, the check runs anyway.
+func (c *Config) serviceDisabled(ctx context.Context, chk check) string {
+	// Once the run is over, Service Usage can't be asked either.
+	if !c.CheckEnabled || chk.service == "" || ctx.Err() != nil {
+		return ""
+	}
+	if c.Project == "" {
+		log.Printf("[WARN] Not checking %s is enabled, since no project is configured", chk.service)
+		return ""
+	}
+	name := fmt.Sprintf("projects/%s/services/%s", c.Project, chk.service)
+	svc, err := c.clientServiceUsage.Services.Get(name).Context(ctx).Do()
+	if err != nil {
+		log.Printf("[WARN] Unable to check %s is enabled on project %q: %s", chk.service, c.Project, describeError(err))
+		return ""
+	}
+	log.Printf("[INFO] %s is %s on project %q", chk.service, strings.ToLower(svc.State), c.Project)
+	if svc.State == "DISABLED" {
+		return fmt.Sprintf("API %s not enabled on project %q; enable it with: gcloud services enable %s --project %s", chk.service, c.Project, chk.service, c.Project)
+	}
+	return ""
+}
+
+// defaultAttempts is how many times each check runs by default.
+const defaultAttempts = 5
+
+// checkTimeout returns how long each call of the check called name may
+// take.
+func (c *Config) checkTimeout(name string) time.Duration {
+	if timeout, ok := c.CheckTimeouts[name]; ok {
+		return timeout
+	}
+	return c.RequestTimeout
+}
+
+// probe runs chk c.Attempts times, stopping at the first error unless
+// c.FailThreshold is set, and reports each attempt as it completes. Each
+// attempt is retried according to the retry policy in c, and each call is
+// bounded by the check's timeout.
+func (c *Config) probe(ctx context.Context, out Reporter, chk check) []Result {
+	var results []Result
+	out.StartCheck(chk.label)
+	for i := 0; i < c.Attempts; i++ {
+		// Only the last call is timed, so the duration measures the API's
+		// latency rather than time spent backing off between retries.
+		var elapsed time.Duration
+		var detail string
+		tries, slept, err := c.retry(ctx, func() error {
+			callCtx, cancel := context.WithTimeout(ctx, c.checkTimeout(chk.name))
+			defer cancel()
+			callCtx, span := startCallSpan(callCtx, chk.name, i+1)
+			start := time.Now()
+			var err error
+			detail, err = chk.run(callCtx, c)
+			elapsed = time.Since(start)
+			endCallSpan(span, elapsed, err)
+			return err
+		})
+		result := c.result(chk.name, i+1, detail, err, elapsed)
+		if err != nil && !result.Skipped && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			// The call was cut short by the run's deadline rather than its
+			// own timeout, so the error says nothing about the network or
+			// which phase of the request was slow.
+			result.Error = c.deadlinePassed(fmt.Sprintf("during attempt %d", i+1))
+			result.Category = CategoryDeadline
+		}
+		if result.Skipped {
+			out.Attempt(result)
+			results = append(results, result)
+			break
+		}
+		result.Tries = tries
+		result.BackoffMs = slept.Milliseconds()
+		out.Attempt(result)
+		results = append(results, result)
+		// With a threshold, failures are tolerated up to a point, so every
+		// attempt runs to measure the success ratio.
+		if (err != nil && c.FailThreshold == 0) || ctx.Err() != nil {
+			break
+		}
+	}
+	out.EndCheck(results)
+	return results
+}
+
+// result describes the outcome of a call of the check called name, which
+// took elapsed and returned detail and err, as the given attempt. A call
+// that succeeded is still a failure if it was slower than c.MaxLatency.
+func (c *Config) result(name string, attempt int, detail string, err error, elapsed time.Duration) Result {
+	var skipErr *skipError
+	if errors.As(err, &skipErr) {
+		return Result{Check: name, Skipped: true, SkipReason: skipErr.reason}
+	}
+	result := Result{
+		Check:      name,
+		Attempt:    attempt,
+		Success:    err == nil,
+		Detail:     detail,
+		Tries:      1,
+		DurationMs: elapsed.Milliseconds(),
+	}
+	if err != nil {
+		result.Error = describeError(err)
+		if phase := timeoutPhase(err); phase != "" {
+			result.Error += " (" + phase + ")"
+		}
+		result.Category = classifyError(err)
+		logQuotaDetails(name, err)
+		if c.FailFastOnHTTP {
+			result.Detail = describeFailure(err)
+		}
+	} else if c.MaxLatency > 0 && elapsed > c.MaxLatency {
+		result.Success = false
+		result.Error = fmt.Sprintf("attempt %d took %s, %s over the maximum latency of %s", attempt, elapsed.Round(time.Millisecond), (elapsed - c.MaxLatency).Round(time.Millisecond), c.MaxLatency)
+		result.Category = CategoryLatency
+	}
+	return result
+}
@@ -0,0 +1,103 @@
+package proxytest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestConfig returns a config loaded with LoadAndValidate that sends
+// every API request to an emulator serving handler, with a fake token.
+// modify, if set, is called on the config before it's loaded.
+func newTestConfig(t *testing.T, handler http.Handler, modify func(*Config)) *Config {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return loadTestConfig(t, srv.URL, modify)
+}
+
+// loadTestConfig returns a config loaded with LoadAndValidate that sends
+// every API request to the emulator at emulator, with a fake token.
+func loadTestConfig(t *testing.T, emulator string, modify func(*Config)) *Config {
+	t.Helper()
+	conf := DefaultConfig()
+	conf.Emulator = emulator
+	conf.FakeToken = true
+	conf.Attempts = 1
+	conf.NoTransportLogging = true
+	if modify != nil {
+		modify(&conf)
+	}
+	if err := conf.LoadAndValidate(); err != nil {
+		t.Fatalf("LoadAndValidate: %s", err)
+	}
+	return &conf
+}
+
+// resultOf returns the first result of the check called name in report.
+func resultOf(t *testing.T, report Report, name string) Result {
+	t.Helper()
+	for _, r := range report.Results {
+		if r.Check == name {
+			return r
+		}
+	}
+	t.Fatalf("no result for the %s check in %+v", name, report.Results)
+	return Result{}
+}
+
+func TestRunChecksAfterCancelSkipsUnselected(t *testing.T) {
+	conf := newTestConfig(t, http.NotFoundHandler(), func(c *Config) {
+		c.Checks = []string{"project"}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report := conf.RunChecks(ctx, nil)
+	if report.Success {
+		t.Error("Success = true, want false for an interrupted run")
+	}
+	for _, r := range report.Results {
+		switch {
+		case r.Check == "project":
+			if r.Category != CategoryInterrupted {
+				t.Errorf("project check has category %q, want %q", r.Category, CategoryInterrupted)
+			}
+		case !r.Skipped || r.SkipReason != notSelected:
+			t.Errorf("unselected %s check = %+v, want it skipped as %q", r.Check, r, notSelected)
+		}
+	}
+	if failed := failedChecks(report); len(failed) != 1 {
+		t.Errorf("failedChecks = %v, want only the project check", failed)
+	}
+}
+
+func TestRunChecksDeadlineDuringCall(t *testing.T) {
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+	conf := newTestConfig(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}), func(c *Config) {
+		c.Checks = []string{"project"}
+		c.Project = "my-project"
+		c.Deadline = 100 * time.Millisecond
+	})
+
+	report := conf.RunChecks(context.Background(), nil)
+	for _, r := range report.Results {
+		if r.Check != "project" {
+			continue
+		}
+		if r.Category != CategoryDeadline {
+			t.Errorf("project check has category %q, want %q", r.Category, CategoryDeadline)
+		}
+		if want := "timed out: the run's deadline of 100ms passed during attempt 1"; r.Error != want {
+			t.Errorf("project check has error %q, want %q", r.Error, want)
+		}
+	}
+}
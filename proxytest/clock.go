@@ -0,0 +1,55 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultMaxClockSkew is well within the few minutes of skew Google
+// tolerates in signed JWTs, so a clock drifting away is caught early.
+const defaultMaxClockSkew = time.Minute
+
+// checkClock compares the local clock to the Date header of a HEAD request
+// to the token endpoint. Service account keys and impersonation sign JWTs
+// with the local time, and a skewed clock gets an invalid_grant error that
+// says nothing about time. The Date header only has a resolution of a
+// second, and the request's latency blurs it further, so skew under a couple
+// of seconds is noise.
+func checkClock(ctx context.Context, c *Config) (string, error) {
+	endpoint := c.endpoint(tokenURL)
+	req, err := http.NewRequestWithContext(ctx, "HEAD", endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	start := time.Now()
+	resp, err := c.tokenClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error reading the time from %s: %w", endpoint, err)
+	}
+	resp.Body.Close()
+	// The server's time is most likely from midway through the request.
+	local := start.Add(time.Since(start) / 2)
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return "", fmt.Errorf("Error reading the time from %s: invalid Date header %q", endpoint, resp.Header.Get("Date"))
+	}
+	// The header is truncated to the second, so on average the server's
+	// time was half a second later.
+	skew := local.Sub(date.Add(time.Second / 2)).Round(time.Second)
+	ahead := "ahead of"
+	if skew < 0 {
+		ahead = "behind"
+	}
+	if skew.Abs() > c.MaxClockSkew {
+		return "", fmt.Errorf("Local clock is %.0fs %s %s, more than the maximum skew of %s; credentials that sign JWTs, e.g. service account keys, will fail with invalid_grant until it's synced",
+			skew.Abs().Seconds(), ahead, req.URL.Host, c.MaxClockSkew)
+	}
+	if skew == 0 {
+		return fmt.Sprintf("local clock matches %s to the second", req.URL.Host), nil
+	}
+	return fmt.Sprintf("local clock is %.0fs %s %s", skew.Abs().Seconds(), ahead, req.URL.Host), nil
+}
@@ -0,0 +1,68 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// CompareCredentials runs every check once for each credentials file in
+// paths, each with its own Config and client built from conf, then reports
+// the results side by side. It returns whether every run succeeded.
+func CompareCredentials(ctx context.Context, conf Config, paths []string, out Reporter) (bool, error) {
+	var reports []Report
+	success := true
+	for _, path := range paths {
+		c := conf
+		c.Credentials = path
+		c.credentialsSource = "-credentials-list"
+		// An access token or token command would take precedence over the
+		// credentials.
+		c.AccessToken = ""
+		c.TokenCommand = ""
+
+		out.Section(path)
+		report := Report{Credentials: path}
+		if err := c.LoadAndValidate(); err != nil {
+			log.Printf("[ERROR] Error loading and validating config for %s: %s", path, err)
+			report.Error = err.Error()
+		} else {
+			out.ConfigLoaded()
+			report = c.RunChecks(ctx, out)
+			report.Credentials = path
+		}
+		success = success && report.Success
+		reports = append(reports, report)
+	}
+	return success, out.Compare(reports)
+}
+
+// CompareProjects runs the project checks once for each of c.Projects,
+// reusing c's clients, then reports the results side by side. It returns
+// whether every run succeeded.
+func CompareProjects(ctx context.Context, c *Config, out Reporter) (bool, error) {
+	var names []string
+	for _, chk := range checks {
+		if chk.project && c.selected(chk.name) {
+			names = append(names, chk.name)
+		}
+	}
+	if len(names) == 0 {
+		return false, fmt.Errorf("None of the selected checks are project checks, so there's nothing to run for each project")
+	}
+
+	var reports []Report
+	success := true
+	for _, project := range c.Projects {
+		pc := *c
+		pc.Project = project
+		pc.Checks = names
+
+		out.Section("project " + project)
+		report := pc.RunChecks(ctx, out)
+		report.Project = project
+		success = success && report.Success
+		reports = append(reports, report)
+	}
+	return success, out.Compare(reports)
+}
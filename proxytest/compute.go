@@ -0,0 +1,19 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+)
+
+// checkCompute lists a zone in the configured project. Most provider users
+// hit proxy and auth problems against the compute endpoint first.
+func checkCompute(ctx context.Context, c *Config) (string, error) {
+	if c.Project == "" {
+		return "", skip("no project configured; set GOOGLE_PROJECT")
+	}
+	_, err := c.clientCompute.Zones.List(c.Project).MaxResults(1).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Error listing compute zones in project %q: %w", c.Project, err)
+	}
+	return "", nil
+}
@@ -0,0 +1,1008 @@
+// Package proxytest checks that Google Cloud APIs can be reached with a set
+// of credentials, typically through a proxy, the way the Terraform Google
+// provider reaches them. Load a Config with LoadAndValidate, then run the
+// checks with RunChecks.
+package proxytest
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/helper/logging"
+	"github.com/hashicorp/terraform/helper/pathorcontents"
+	"github.com/hashicorp/terraform/httpclient"
+	"github.com/terraform-providers/terraform-provider-google/version"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/oauth2"
+	googleoauth "golang.org/x/oauth2/google"
+	"google.golang.org/api/cloudbilling/v1"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	resourceManagerV2 "google.golang.org/api/cloudresourcemanager/v2"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"google.golang.org/api/serviceusage/v1"
+	"google.golang.org/api/storage/v1"
+)
+
+// Config holds the settings for a run. The struct tags name each setting's
+// key in a config file.
+type Config struct {
+	Credentials string `yaml:"credentials" toml:"credentials"`
+	AccessToken string `yaml:"access_token" toml:"access_token"`
+	// TokenCommand is a command that prints an access token, used instead
+	// of Credentials.
+	TokenCommand string   `yaml:"token_command" toml:"token_command"`
+	Scopes       []string `yaml:"scopes" toml:"scopes"`
+
+	// credentialsSource describes where Credentials was set, for logging.
+	credentialsSource string
+
+	// Project is the project used by checks of project-scoped APIs.
+	Project string `yaml:"project" toml:"project"`
+	// Projects, if set, are each checked by the project-scoped checks in
+	// turn, instead of Project.
+	Projects []string `yaml:"projects" toml:"projects"`
+
+	// Subject is the user a service account key impersonates with
+	// domain-wide delegation.
+	Subject string `yaml:"subject" toml:"subject"`
+
+	ImpersonateServiceAccount          string   `yaml:"impersonate_service_account" toml:"impersonate_service_account"`
+	ImpersonateServiceAccountDelegates []string `yaml:"impersonate_service_account_delegates" toml:"impersonate_service_account_delegates"`
+
+	ProxyURL string `yaml:"proxy_url" toml:"proxy_url"`
+	// MaxIdleConns, IdleConnTimeout, and DisableKeepAlives tune the
+	// transport's connection pool, e.g. to open a fresh connection for every
+	// request.
+	MaxIdleConns      int           `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	IdleConnTimeout   time.Duration `yaml:"idle_conn_timeout" toml:"idle_conn_timeout"`
+	DisableKeepAlives bool          `yaml:"disable_keep_alives" toml:"disable_keep_alives"`
+
+	// HTTPVersion restricts requests to HTTP/1.1 ("1.1") or HTTP/2 ("2");
+	// "auto" negotiates either.
+	HTTPVersion string `yaml:"http_version" toml:"http_version"`
+
+	// IPVersion restricts connections to IPv4 ("4") or IPv6 ("6"); "auto"
+	// uses either.
+	IPVersion string `yaml:"ip_version" toml:"ip_version"`
+
+	// ProxyUser and ProxyPassword authenticate to the proxy with Basic auth,
+	// without putting the credentials in ProxyURL, where they'd be logged.
+	ProxyUser     string `yaml:"proxy_user" toml:"proxy_user"`
+	ProxyPassword string `yaml:"proxy_password" toml:"proxy_password"`
+
+	// UniverseDomain is the domain of the Google Cloud universe to use, in
+	// place of googleapis.com, e.g. for Trusted Partner Cloud.
+	UniverseDomain string `yaml:"universe_domain" toml:"universe_domain"`
+
+	// Emulator is the URL of a mock server to send every API request to
+	// instead of Google, e.g. for testing without network access.
+	// FakeToken skips authenticating, sending a fake token instead.
+	Emulator  string `yaml:"emulator" toml:"emulator"`
+	FakeToken bool   `yaml:"fake_token" toml:"fake_token"`
+
+	// BillingBasePath and ResourceManagerBasePath override the default
+	// endpoints of those APIs, e.g. to use a mirror or a local mock.
+	BillingBasePath         string `yaml:"billing_base_path" toml:"billing_base_path"`
+	ResourceManagerBasePath string `yaml:"resource_manager_base_path" toml:"resource_manager_base_path"`
+
+	// CABundle is the path to a PEM file of extra CA certificates to trust.
+	CABundle string `yaml:"ca_bundle" toml:"ca_bundle"`
+	// Insecure disables TLS verification. It only takes effect when
+	// GCP_ALLOW_INSECURE=1 is also set, so it can't be left on by accident.
+	Insecure bool `yaml:"insecure" toml:"insecure"`
+
+	// NoTransportLogging skips wrapping the client's transport in the
+	// provider's logging transport, whose buffering skews latencies.
+	NoTransportLogging bool `yaml:"no_transport_logging" toml:"no_transport_logging"`
+
+	// OTelEndpoint is the URL of an OpenTelemetry collector to export spans
+	// of each check's calls to over OTLP/HTTP.
+	OTelEndpoint string `yaml:"otel_endpoint" toml:"otel_endpoint"`
+
+	// UserAgentSuffix is appended to the User-Agent of every API request, so
+	// the tool's traffic can be picked out of proxy logs.
+	UserAgentSuffix string `yaml:"user_agent_suffix" toml:"user_agent_suffix"`
+
+	// CheckEnabled verifies that each API is enabled on Project before
+	// checking it, skipping the check if it isn't.
+	CheckEnabled bool `yaml:"check_enabled" toml:"check_enabled"`
+
+	// Checks selects the checks to run; all checks run when it's empty.
+	Checks []string `yaml:"checks" toml:"checks"`
+	// Parallel is the number of checks to run at once.
+	Parallel int `yaml:"parallel" toml:"parallel"`
+
+	// Attempts is the number of times each check is run.
+	Attempts int `yaml:"attempts" toml:"attempts"`
+	// FailThreshold is how many of the attempts of a check must succeed
+	// for it to pass, for networks where some loss is expected; zero means
+	// all of them.
+	FailThreshold int `yaml:"fail_threshold" toml:"fail_threshold"`
+
+	// RefreshWait is how long -verify-refresh waits before treating the
+	// first token as expired.
+	RefreshWait time.Duration `yaml:"refresh_wait" toml:"refresh_wait"`
+
+	// Deadline bounds a whole run of the checks, including retries; zero
+	// means no limit.
+	Deadline time.Duration `yaml:"deadline" toml:"deadline"`
+
+	// MaxClockSkew fails the clock check if the local clock is further
+	// than this from Google's.
+	MaxClockSkew time.Duration `yaml:"max_clock_skew" toml:"max_clock_skew"`
+
+	// MaxLatency fails any attempt of a check that takes longer, even if it
+	// succeeded; zero means no limit.
+	MaxLatency time.Duration `yaml:"max_latency" toml:"max_latency"`
+
+	// RequestTimeout bounds each individual HTTP request.
+	RequestTimeout time.Duration `yaml:"request_timeout" toml:"request_timeout"`
+	// ConnectTimeout bounds establishing each TCP connection, to Google or
+	// a proxy, separately from the request as a whole.
+	ConnectTimeout time.Duration `yaml:"connect_timeout" toml:"connect_timeout"`
+	// MaxResponseSize fails any response with a larger body, as one that
+	// big is more likely a proxy's page than an API response; zero means
+	// no limit.
+	MaxResponseSize int64 `yaml:"max_response_size" toml:"max_response_size"`
+	// CheckTimeouts bound each call of the named checks instead of
+	// RequestTimeout, for endpoints that are slower than the rest.
+	CheckTimeouts map[string]time.Duration `yaml:"check_timeouts" toml:"check_timeouts"`
+
+	// Failed requests are retried up to RetryMaxAttempts calls in total,
+	// backing off exponentially from RetryBaseDelay.
+	RetryMaxAttempts int           `yaml:"retry_max_attempts" toml:"retry_max_attempts"`
+	RetryBaseDelay   time.Duration `yaml:"retry_base_delay" toml:"retry_base_delay"`
+	// RetryOn are the HTTP status codes that are retried, instead of
+	// retryableStatusCodes.
+	RetryOn []int `yaml:"retry_on" toml:"retry_on"`
+	// FailFastOnHTTP only retries network errors, treating any HTTP
+	// response as final, to separate flaky networks from auth failures.
+	FailFastOnHTTP bool `yaml:"fail_fast_on_http" toml:"fail_fast_on_http"`
+
+	// When UserProjectOverride is set, quota and billing for API calls are
+	// charged to BillingProject rather than the credentials' own project.
+	UserProjectOverride bool   `yaml:"user_project_override" toml:"user_project_override"`
+	BillingProject      string `yaml:"billing_project" toml:"billing_project"`
+
+	// Permissions are the IAM permissions the credentials are expected to
+	// hold on Project.
+	Permissions []string `yaml:"permissions" toml:"permissions"`
+
+	// BillingAccount is the billing account Project is expected to be
+	// linked to.
+	BillingAccount string `yaml:"billing_account" toml:"billing_account"`
+
+	// Region is substituted for {region} in RegionalEndpoints, host
+	// templates like {region}-run.googleapis.com of regional endpoints to
+	// probe.
+	Region            string   `yaml:"region" toml:"region"`
+	RegionalEndpoints []string `yaml:"regional_endpoints" toml:"regional_endpoints"`
+
+	// OrgID is the organization read by the org check, as
+	// organizations/ID; a bare ID is accepted.
+	OrgID string `yaml:"org_id" toml:"org_id"`
+
+	// OrgFilter narrows the organization search, e.g. to
+	// domain:example.com.
+	OrgFilter string `yaml:"org_filter" toml:"org_filter"`
+
+	// FolderParent is the organization or folder whose folders are listed,
+	// as organizations/ID or folders/ID; a bare ID is an organization.
+	FolderParent string `yaml:"folder_parent" toml:"folder_parent"`
+
+	// FullList makes the billing and org checks page through every result
+	// rather than fetching only the first page, fetching at most MaxPages.
+	FullList bool `yaml:"full_list" toml:"full_list"`
+	MaxPages int  `yaml:"max_pages" toml:"max_pages"`
+
+	// ReloadCredentials re-reads the credentials before every run after the
+	// first when running repeatedly, e.g. with -watch or -serve, to pick up
+	// rotated keys. Otherwise they're read once by LoadAndValidate.
+	ReloadCredentials bool `yaml:"reload_credentials" toml:"reload_credentials"`
+
+	// ProbeURL is sent an authenticated GET by the probe-url check, for
+	// APIs without a check of their own. It must be an HTTPS URL in the
+	// universe domain, unless ProbeAnyHost is set.
+	ProbeURL     string `yaml:"probe_url" toml:"probe_url"`
+	ProbeAnyHost bool   `yaml:"probe_any_host" toml:"probe_any_host"`
+
+	transport *http.Transport
+	client    *http.Client
+	userAgent string
+
+	tokenSource *swapTokenSource
+	// mints counts the tokens fetched by tokenSource.
+	mints *countingTokenSource
+	// tokenClient is the client token requests are made with.
+	tokenClient *http.Client
+	// identity describes who the credentials authenticate as, as far as
+	// can be told without calling any API, and token is the token minted
+	// while validating them.
+	identity string
+	token    *oauth2.Token
+
+	clientBilling           *cloudbilling.APIService
+	clientResourceManager   *cloudresourcemanager.Service
+	clientResourceManagerV2 *resourceManagerV2.Service
+	clientCompute           *compute.Service
+	clientStorage           *storage.Service
+	clientDNS               *dns.Service
+	clientServiceUsage      *serviceusage.Service
+
+	tracerProvider *sdktrace.TracerProvider
+	conns          *connStats
+}
+
+// defaultRequestTimeout is used when no request timeout is configured. Each
+// individual request should return within 30s - timeouts will be retried.
+// This is a timeout for, e.g. a single GET request of an operation - not a
+// timeout for the maximum amount of time a logical request can take.
+const defaultRequestTimeout = 30 * time.Second
+
+// DefaultConfig returns a Config with the default for each setting that has
+// one.
+func DefaultConfig() Config {
+	return Config{
+		HTTPVersion:      httpVersionAuto,
+		IPVersion:        ipVersionAuto,
+		MaxIdleConns:     defaultMaxIdleConns,
+		IdleConnTimeout:  defaultIdleConnTimeout,
+		Attempts:         defaultAttempts,
+		RefreshWait:      defaultRefreshWait,
+		RequestTimeout:   defaultRequestTimeout,
+		ConnectTimeout:   defaultConnectTimeout,
+		MaxResponseSize:  defaultMaxResponseSize,
+		MaxClockSkew:     defaultMaxClockSkew,
+		RetryMaxAttempts: defaultRetryMaxAttempts,
+		RetryBaseDelay:   defaultRetryBaseDelay,
+		MaxPages:         defaultMaxPages,
+	}
+}
+
+// ConfigFromEnv returns conf with each setting that's set in the environment
+// overridden by the environment's value.
+func ConfigFromEnv(conf Config) (Config, error) {
+	// GOOGLE_APPLICATION_CREDENTIALS comes last, so the provider's own
+	// variables win just as they do in Terraform.
+	if k := envString(&conf.Credentials, "GOOGLE_CREDENTIALS", "GOOGLE_CLOUD_KEYFILE_JSON", "GOOGLE_KEYFILE_JSON", "GOOGLE_APPLICATION_CREDENTIALS"); k != "" {
+		conf.credentialsSource = k
+	}
+	// CI systems often store keys base64-encoded, so newlines survive.
+	if v := os.Getenv("GOOGLE_CREDENTIALS_BASE64"); v != "" {
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(v), ""))
+		if err != nil {
+			return conf, fmt.Errorf("GOOGLE_CREDENTIALS_BASE64 is not valid base64: %s", err)
+		}
+		conf.Credentials = string(decoded)
+		conf.credentialsSource = "GOOGLE_CREDENTIALS_BASE64"
+	}
+	envString(&conf.AccessToken, "GOOGLE_OAUTH_ACCESS_TOKEN")
+	envString(&conf.TokenCommand, "GCP_TOKEN_COMMAND")
+	envList(&conf.Scopes, "GOOGLE_SCOPES")
+	envString(&conf.Project, "GOOGLE_PROJECT")
+	envList(&conf.Projects, "GOOGLE_PROJECTS")
+	envString(&conf.Subject, "GOOGLE_SUBJECT")
+	envString(&conf.ImpersonateServiceAccount, "GOOGLE_IMPERSONATE_SERVICE_ACCOUNT")
+	envList(&conf.ImpersonateServiceAccountDelegates, "GOOGLE_IMPERSONATE_SERVICE_ACCOUNT_DELEGATES")
+	envString(&conf.ProxyURL, "GCP_PROXY_URL")
+	envString(&conf.ProxyUser, "GCP_PROXY_USER")
+	envString(&conf.ProxyPassword, "GCP_PROXY_PASSWORD")
+	envString(&conf.CABundle, "GCP_CA_BUNDLE")
+	envString(&conf.UniverseDomain, "GOOGLE_CLOUD_UNIVERSE_DOMAIN")
+	envString(&conf.BillingBasePath, "GOOGLE_BILLING_CUSTOM_ENDPOINT")
+	envString(&conf.ResourceManagerBasePath, "GOOGLE_RESOURCE_MANAGER_CUSTOM_ENDPOINT")
+	envString(&conf.BillingProject, "GOOGLE_BILLING_PROJECT")
+	envString(&conf.BillingAccount, "GOOGLE_BILLING_ACCOUNT")
+	envString(&conf.OrgID, "GOOGLE_ORG_ID")
+	envString(&conf.FolderParent, "GOOGLE_FOLDER_PARENT")
+	envString(&conf.OrgFilter, "GOOGLE_ORG_FILTER")
+	envString(&conf.Region, "GOOGLE_REGION")
+	envList(&conf.RegionalEndpoints, "GOOGLE_REGIONAL_ENDPOINTS")
+	envList(&conf.Permissions, "GOOGLE_PERMISSIONS")
+	if err := envBool(&conf.UserProjectOverride, "USER_PROJECT_OVERRIDE"); err != nil {
+		return conf, err
+	}
+	if err := envDuration(&conf.RequestTimeout, "GCP_REQUEST_TIMEOUT"); err != nil {
+		return conf, err
+	}
+	if err := envDuration(&conf.ConnectTimeout, "GCP_CONNECT_TIMEOUT"); err != nil {
+		return conf, err
+	}
+	return conf, nil
+}
+
+// envString sets dst to the first of the variables ks that's set, returning
+// its name, or "" if none are.
+func envString(dst *string, ks ...string) string {
+	for _, k := range ks {
+		if v := os.Getenv(k); v != "" {
+			*dst = v
+			return k
+		}
+	}
+	return ""
+}
+
+// envList sets dst to the comma-separated list in the variable k, if set.
+func envList(dst *[]string, k string) {
+	if v := os.Getenv(k); v != "" {
+		*dst = SplitList(v)
+	}
+}
+
+// envBool sets dst to the boolean in the variable k, if set.
+func envBool(dst *bool, k string) error {
+	v := os.Getenv(k)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q: %s", k, v, err)
+	}
+	*dst = b
+	return nil
+}
+
+// envDuration sets dst to the duration in the variable k, if set.
+func envDuration(dst *time.Duration, k string) error {
+	v := os.Getenv(k)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q: %s", k, v, err)
+	}
+	*dst = d
+	return nil
+}
+
+// SplitList splits a comma-separated value, trimming whitespace and dropping
+// empty entries.
+func SplitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+var defaultClientScopes = []string{
+	"https://www.googleapis.com/auth/compute",
+	"https://www.googleapis.com/auth/cloud-platform",
+	"https://www.googleapis.com/auth/ndev.clouddns.readwrite",
+	"https://www.googleapis.com/auth/devstorage.full_control",
+}
+
+func (c *Config) LoadAndValidate() error {
+	if len(c.Scopes) == 0 {
+		c.Scopes = defaultClientScopes
+	}
+	if err := validateChecks(c.Checks); err != nil {
+		return err
+	}
+	if c.Parallel < 0 {
+		return fmt.Errorf("Parallel must not be negative, got %d", c.Parallel)
+	}
+	if c.MaxIdleConns < 0 {
+		return fmt.Errorf("Max idle connections must not be negative, got %d", c.MaxIdleConns)
+	}
+	if c.IdleConnTimeout < 0 {
+		return fmt.Errorf("Idle connection timeout must not be negative, got %s", c.IdleConnTimeout)
+	}
+	switch c.HTTPVersion {
+	case httpVersionAuto, httpVersion1, httpVersion2:
+	default:
+		return fmt.Errorf("Invalid HTTP version %q; valid versions are %s, %s, and %s", c.HTTPVersion, httpVersion1, httpVersion2, httpVersionAuto)
+	}
+	switch c.IPVersion {
+	case ipVersionAuto, ipVersion4, ipVersion6:
+	default:
+		return fmt.Errorf("Invalid IP version %q; valid versions are %s, %s, and %s", c.IPVersion, ipVersion4, ipVersion6, ipVersionAuto)
+	}
+	if c.Attempts < 1 {
+		return fmt.Errorf("Attempts must be at least 1, got %d", c.Attempts)
+	}
+	if c.FailThreshold < 0 || c.FailThreshold > c.Attempts {
+		return fmt.Errorf("Fail threshold must be between 0 and the %d attempts, got %d", c.Attempts, c.FailThreshold)
+	}
+	if c.RefreshWait < 0 {
+		return fmt.Errorf("Refresh wait must not be negative, got %s", c.RefreshWait)
+	}
+	if c.Deadline < 0 {
+		return fmt.Errorf("Deadline must not be negative, got %s", c.Deadline)
+	}
+	if c.MaxClockSkew < 0 {
+		return fmt.Errorf("Max clock skew must not be negative, got %s", c.MaxClockSkew)
+	}
+	if c.MaxLatency < 0 {
+		return fmt.Errorf("Max latency must not be negative, got %s", c.MaxLatency)
+	}
+	if c.RequestTimeout <= 0 {
+		return fmt.Errorf("Request timeout must be positive, got %s", c.RequestTimeout)
+	}
+	if c.ConnectTimeout <= 0 {
+		return fmt.Errorf("Connect timeout must be positive, got %s", c.ConnectTimeout)
+	}
+	if c.MaxResponseSize < 0 {
+		return fmt.Errorf("Max response size must not be negative, got %d", c.MaxResponseSize)
+	}
+	for name, timeout := range c.CheckTimeouts {
+		if _, ok := lookupCheck(name); !ok {
+			return fmt.Errorf("Invalid timeout for %q: %s", name, validateChecks([]string{name}))
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("Timeout of the %s check must be positive, got %s", name, timeout)
+		}
+	}
+	if c.RetryMaxAttempts < 1 {
+		return fmt.Errorf("Retry max attempts must be at least 1, got %d", c.RetryMaxAttempts)
+	}
+	if c.RetryBaseDelay < 0 {
+		return fmt.Errorf("Retry base delay must not be negative, got %s", c.RetryBaseDelay)
+	}
+	for _, code := range c.RetryOn {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("Invalid status code %d to retry on; status codes are between 100 and 599", code)
+		}
+	}
+	if c.FailFastOnHTTP && len(c.RetryOn) > 0 {
+		log.Printf("[WARN] Ignoring the status codes to retry on, since fail fast on HTTP never retries HTTP responses")
+	}
+	log.Printf("[INFO] Retrying on HTTP status codes: %v", c.retryStatusCodes())
+	if c.MaxPages < 1 {
+		return fmt.Errorf("Max pages must be at least 1, got %d", c.MaxPages)
+	}
+	if c.UserProjectOverride && c.BillingProject == "" {
+		return fmt.Errorf("USER_PROJECT_OVERRIDE is set, but GOOGLE_BILLING_PROJECT is not; set it to the project quota should be charged to")
+	}
+	for _, scope := range c.Scopes {
+		if err := validateScope(scope); err != nil {
+			return err
+		}
+	}
+	var err error
+	if c.BillingBasePath, err = normalizeEndpoint(c.BillingBasePath); err != nil {
+		return fmt.Errorf("Invalid billing endpoint: %s", err)
+	}
+	if c.ResourceManagerBasePath, err = normalizeEndpoint(c.ResourceManagerBasePath); err != nil {
+		return fmt.Errorf("Invalid resource manager endpoint: %s", err)
+	}
+	if c.OrgID, err = normalizeOrgID(c.OrgID); err != nil {
+		return fmt.Errorf("Invalid organization ID: %s", err)
+	}
+	if c.FolderParent, err = normalizeFolderParent(c.FolderParent); err != nil {
+		return fmt.Errorf("Invalid folder parent: %s", err)
+	}
+	if c.BillingAccount, err = normalizeBillingAccount(c.BillingAccount); err != nil {
+		return fmt.Errorf("Invalid billing account: %s", err)
+	}
+
+	if c.UniverseDomain == "" {
+		c.UniverseDomain = defaultUniverseDomain
+	}
+	if strings.ContainsAny(c.UniverseDomain, "/:") {
+		return fmt.Errorf("Invalid universe domain %q: it must be a bare domain, e.g. %s", c.UniverseDomain, defaultUniverseDomain)
+	}
+	log.Printf("[INFO] Using universe domain %s", c.UniverseDomain)
+	if c.ProbeURL != "" {
+		if err := c.validateProbeURL(c.ProbeURL, c.ProbeAnyHost); err != nil {
+			return fmt.Errorf("Invalid probe URL: %s", err)
+		}
+	}
+	if c.Emulator != "" {
+		if c.Emulator, err = validateEmulator(c.Emulator); err != nil {
+			return fmt.Errorf("Invalid emulator: %s", err)
+		}
+	}
+
+	if len(c.ImpersonateServiceAccountDelegates) > 0 && c.ImpersonateServiceAccount == "" {
+		return fmt.Errorf("Impersonation delegates %s were set, but no service account to impersonate was; set GOOGLE_IMPERSONATE_SERVICE_ACCOUNT to the target of the delegation chain", c.ImpersonateServiceAccountDelegates)
+	}
+
+	if c.OTelEndpoint != "" {
+		if err := c.setupTracing(c.OTelEndpoint); err != nil {
+			return err
+		}
+	}
+
+	transport, err := c.newTransport()
+	if err != nil {
+		return err
+	}
+	if err := c.trustEmulator(transport.TLSClientConfig); err != nil {
+		return err
+	}
+	c.transport = transport
+
+	c.conns = &connStats{}
+	var base http.RoundTripper = &reuseTransport{stats: c.conns, transport: transport}
+	base = &responseGuardTransport{max: c.MaxResponseSize, emulator: c.Emulator != "", transport: base}
+	if logging.IsDebugOrHigher() {
+		base = &debugTransport{transport: base}
+	}
+	if c.tracerProvider != nil {
+		// Every request, including token requests, becomes a child span of
+		// the call that made it, and carries the trace context.
+		base = otelhttp.NewTransport(base)
+	}
+
+	// Token requests go through the same transport as API requests, so
+	// credentials that can't reach the token endpoint through the proxy fail
+	// here.
+	c.tokenClient = &http.Client{Transport: base}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, c.tokenClient)
+
+	tokenSource, err := c.getTokenSource(ctx, c.Scopes)
+	if err != nil {
+		return err
+	}
+	// Most sources already cache their token, but not all do, and wrapping
+	// them explicitly lets the number of tokens minted be counted.
+	c.mints = &countingTokenSource{source: tokenSource}
+	// Clients keep this source, so reloaded credentials can be swapped in.
+	c.tokenSource = &swapTokenSource{source: oauth2.ReuseTokenSource(nil, c.mints)}
+	tokenSource = c.tokenSource
+
+	// Mint a token up front so credential problems show up here, rather
+	// than as a failure of whichever API happens to be called first.
+	token, err := tokenSource.Token()
+	if err != nil {
+		return fmt.Errorf("Error retrieving token: %s", err)
+	}
+	logToken(token)
+	c.token = token
+
+	client := oauth2.NewClient(ctx, tokenSource)
+	if c.UserProjectOverride {
+		log.Printf("[INFO] Charging quota to billing project %q", c.BillingProject)
+		client.Transport = &userProjectTransport{project: c.BillingProject, transport: client.Transport}
+	}
+	if !c.NoTransportLogging {
+		client.Transport = logging.NewTransport("Google", client.Transport)
+	}
+	// Each call of a check is bounded by its own timeout, so the client's
+	// timeout only has to allow for the longest.
+	client.Timeout = c.RequestTimeout
+	for _, timeout := range c.CheckTimeouts {
+		client.Timeout = max(client.Timeout, timeout)
+	}
+
+	terraformVersion := httpclient.UserAgentString()
+	providerVersion := fmt.Sprintf("terraform-provider-google/%s", version.ProviderVersion)
+	terraformWebsite := "(+https://www.terraform.io)"
+	userAgent := fmt.Sprintf("%s %s %s", terraformVersion, terraformWebsite, providerVersion)
+	if c.UserAgentSuffix != "" {
+		userAgent = fmt.Sprintf("%s %s", userAgent, c.UserAgentSuffix)
+	}
+	log.Printf("[INFO] Using User-Agent %q", userAgent)
+
+	c.client = client
+	c.userAgent = userAgent
+
+	log.Printf("[INFO] Instantiating Google Cloud ResourceManager Client...")
+	c.clientResourceManager, err = cloudresourcemanager.New(client)
+	if err != nil {
+		return err
+	}
+	c.clientResourceManager.UserAgent = userAgent
+	c.clientResourceManager.BasePath = c.endpoint(c.clientResourceManager.BasePath)
+	if c.ResourceManagerBasePath != "" {
+		c.clientResourceManager.BasePath = c.ResourceManagerBasePath
+	}
+	log.Printf("[INFO]   -- Endpoint: %s", c.clientResourceManager.BasePath)
+	logProxy(transport, c.clientResourceManager.BasePath)
+
+	log.Printf("[INFO] Instantiating Google Cloud ResourceManager V2 Client...")
+	c.clientResourceManagerV2, err = resourceManagerV2.New(client)
+	if err != nil {
+		return err
+	}
+	c.clientResourceManagerV2.UserAgent = userAgent
+	c.clientResourceManagerV2.BasePath = c.endpoint(c.clientResourceManagerV2.BasePath)
+	if c.ResourceManagerBasePath != "" {
+		c.clientResourceManagerV2.BasePath = c.ResourceManagerBasePath
+	}
+
+	log.Printf("[INFO] Instantiating Google Cloud Billing Client...")
+	c.clientBilling, err = cloudbilling.New(client)
+	if err != nil {
+		return err
+	}
+	c.clientBilling.UserAgent = userAgent
+	c.clientBilling.BasePath = c.endpoint(c.clientBilling.BasePath)
+	if c.BillingBasePath != "" {
+		c.clientBilling.BasePath = c.BillingBasePath
+	}
+	log.Printf("[INFO]   -- Endpoint: %s", c.clientBilling.BasePath)
+	logProxy(transport, c.clientBilling.BasePath)
+
+	log.Printf("[INFO] Instantiating GCE client...")
+	c.clientCompute, err = compute.New(client)
+	if err != nil {
+		return err
+	}
+	c.clientCompute.UserAgent = userAgent
+	c.clientCompute.BasePath = c.endpoint(c.clientCompute.BasePath)
+	logProxy(transport, c.clientCompute.BasePath)
+
+	log.Printf("[INFO] Instantiating Google Storage client...")
+	c.clientStorage, err = storage.New(client)
+	if err != nil {
+		return err
+	}
+	c.clientStorage.UserAgent = userAgent
+	c.clientStorage.BasePath = c.endpoint(c.clientStorage.BasePath)
+	logProxy(transport, c.clientStorage.BasePath)
+
+	log.Printf("[INFO] Instantiating Google Cloud DNS client...")
+	c.clientDNS, err = dns.New(client)
+	if err != nil {
+		return err
+	}
+	c.clientDNS.UserAgent = userAgent
+	c.clientDNS.BasePath = c.endpoint(c.clientDNS.BasePath)
+	logProxy(transport, c.clientDNS.BasePath)
+
+	if c.CheckEnabled {
+		log.Printf("[INFO] Instantiating Service Usage client...")
+		c.clientServiceUsage, err = serviceusage.New(client)
+		if err != nil {
+			return err
+		}
+		c.clientServiceUsage.UserAgent = userAgent
+		c.clientServiceUsage.BasePath = c.endpoint(c.clientServiceUsage.BasePath)
+		logProxy(transport, c.clientServiceUsage.BasePath)
+	}
+
+	return nil
+}
+
+// logToken logs the type and expiry of token, warning about expiries that
+// will cause requests to fail. The token value itself is never logged.
+func logToken(token *oauth2.Token) {
+	log.Printf("[INFO] Retrieved token of type %q", token.Type())
+	switch {
+	case token.Expiry.IsZero():
+		log.Printf("[WARN]   -- Expiry: none; the token will not be refreshed")
+	case token.Expiry.Before(time.Now()):
+		log.Printf("[WARN]   -- Expiry: %s, which is %s in the past; check the local clock", token.Expiry, time.Since(token.Expiry).Round(time.Second))
+	default:
+		log.Printf("[INFO]   -- Expiry: %s (in %s)", token.Expiry, time.Until(token.Expiry).Round(time.Second))
+	}
+}
+
+// validateScope checks that scope looks like an OAuth scope URL, so typos
+// like "cloud-platform" fail here instead of as an opaque token error.
+func validateScope(scope string) error {
+	u, err := url.Parse(scope)
+	if err != nil {
+		return fmt.Errorf("Invalid scope %q: %s", scope, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("Invalid scope %q: scopes must be URLs, e.g. https://www.googleapis.com/auth/cloud-platform", scope)
+	}
+	return nil
+}
+
+// normalizeEndpoint validates a custom API endpoint, returning it with the
+// trailing slash the generated clients expect. An empty endpoint means the
+// API's default and is returned as is.
+func normalizeEndpoint(endpoint string) (string, error) {
+	if endpoint == "" {
+		return "", nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("%q must be an http or https URL, e.g. https://cloudbilling.googleapis.com/", endpoint)
+	}
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+	return endpoint, nil
+}
+
+var (
+	orgIDPattern          = regexp.MustCompile(`^organizations/\d+$`)
+	folderParentPattern   = regexp.MustCompile(`^(organizations|folders)/\d+$`)
+	billingAccountPattern = regexp.MustCompile(`^billingAccounts/[0-9A-Z]{6}-[0-9A-Z]{6}-[0-9A-Z]{6}$`)
+)
+
+// normalizeOrgID validates an organization ID, returning it as
+// organizations/ID; a bare ID is accepted. An empty ID is returned as is.
+func normalizeOrgID(id string) (string, error) {
+	if id == "" {
+		return "", nil
+	}
+	normalized := strings.TrimSpace(id)
+	if !strings.Contains(normalized, "/") {
+		normalized = "organizations/" + normalized
+	}
+	if !orgIDPattern.MatchString(normalized) {
+		if strings.HasPrefix(normalized, "projects/") || strings.HasPrefix(normalized, "folders/") {
+			return "", fmt.Errorf("%q is not an organization; the org check needs organizations/ID", id)
+		}
+		return "", fmt.Errorf("%q must be organizations/ID or a bare organization ID, where IDs are numeric, e.g. organizations/123456789012", id)
+	}
+	return normalized, nil
+}
+
+// normalizeFolderParent validates a folder parent, returning it as
+// organizations/ID or folders/ID; a bare ID is an organization. An empty
+// parent is returned as is.
+func normalizeFolderParent(parent string) (string, error) {
+	if parent == "" {
+		return "", nil
+	}
+	normalized := strings.TrimSpace(parent)
+	if !strings.Contains(normalized, "/") {
+		normalized = "organizations/" + normalized
+	}
+	if !folderParentPattern.MatchString(normalized) {
+		if strings.HasPrefix(normalized, "projects/") {
+			return "", fmt.Errorf("%q is a project, not an organization or folder; folders can only be listed under organizations/ID or folders/ID", parent)
+		}
+		return "", fmt.Errorf("%q must be organizations/ID or folders/ID, or a bare organization ID, where IDs are numeric", parent)
+	}
+	return normalized, nil
+}
+
+// normalizeBillingAccount validates a billing account ID, returning it as
+// billingAccounts/XXXXXX-XXXXXX-XXXXXX. An empty ID is returned as is.
+func normalizeBillingAccount(account string) (string, error) {
+	if account == "" {
+		return "", nil
+	}
+	normalized := strings.ToUpper(strings.TrimSpace(account))
+	normalized = "billingAccounts/" + strings.TrimPrefix(normalized, "BILLINGACCOUNTS/")
+	if !billingAccountPattern.MatchString(normalized) {
+		return "", fmt.Errorf("%q must be a billing account ID like 012345-6789AB-CDEF01, optionally prefixed with billingAccounts/", account)
+	}
+	return normalized, nil
+}
+
+func (c *Config) getTokenSource(ctx context.Context, clientScopes []string) (oauth2.TokenSource, error) {
+	tokenSource, err := c.getBaseTokenSource(ctx, clientScopes)
+	if err != nil {
+		return nil, err
+	}
+	if c.ImpersonateServiceAccount == "" {
+		return tokenSource, nil
+	}
+
+	// The base credentials act as the delegate that is allowed to mint tokens
+	// for the target service account; every API call then uses the target.
+	log.Printf("[INFO]   -- Impersonating: %s", c.ImpersonateServiceAccount)
+	c.identity = c.ImpersonateServiceAccount + " (impersonated)"
+	if len(c.ImpersonateServiceAccountDelegates) > 0 {
+		chain := append([]string{"<credentials>"}, c.ImpersonateServiceAccountDelegates...)
+		chain = append(chain, c.ImpersonateServiceAccount)
+		log.Printf("[INFO]   -- Delegation chain: %s", strings.Join(chain, " -> "))
+	}
+	impersonated, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: c.ImpersonateServiceAccount,
+		Delegates:       c.ImpersonateServiceAccountDelegates,
+		Scopes:          clientScopes,
+	}, option.WithHTTPClient(oauth2.NewClient(ctx, tokenSource)))
+	if err != nil {
+		return nil, fmt.Errorf("Error impersonating service account %q: %s", c.ImpersonateServiceAccount, err)
+	}
+	return impersonated, nil
+}
+
+// ReadTokenStdin sets c's access token to the one read from r, for
+// -token-stdin, so it's never on the command line or in a file. It's an
+// error if any other credentials are configured.
+func (c *Config) ReadTokenStdin(r io.Reader, credentialsList []string) error {
+	var others []string
+	if c.AccessToken != "" {
+		others = append(others, "an access token")
+	}
+	if c.TokenCommand != "" {
+		others = append(others, "a token command")
+	}
+	if c.Credentials != "" {
+		others = append(others, "credentials")
+	}
+	if len(credentialsList) > 0 {
+		others = append(others, "-credentials-list")
+	}
+	if len(others) > 0 {
+		return fmt.Errorf("-token-stdin can't be combined with other credentials, but these are also configured: %s", strings.Join(others, ", "))
+	}
+
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Error reading access token from stdin: %s", err)
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return fmt.Errorf("No access token was read from stdin")
+	}
+	c.AccessToken = token
+	return nil
+}
+
+func (c *Config) getBaseTokenSource(ctx context.Context, clientScopes []string) (oauth2.TokenSource, error) {
+	if c.FakeToken {
+		return c.fakeTokenSource(), nil
+	}
+	if c.Subject != "" && (c.AccessToken != "" || c.TokenCommand != "" || c.Credentials == "") {
+		return nil, fmt.Errorf("GOOGLE_SUBJECT was set, but domain-wide delegation needs service account key credentials; set GOOGLE_CREDENTIALS instead of other credentials")
+	}
+	if c.AccessToken != "" {
+		contents, _, err := pathorcontents.Read(c.AccessToken)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading access token: %s", err)
+		}
+
+		log.Printf("[INFO] Authenticating using configured Google JSON 'access_token'...")
+		log.Printf("[INFO]   -- Scopes: %s", clientScopes)
+		logScopeNotes(accessTokenScopes, c.scopesNarrowed())
+		token := &oauth2.Token{AccessToken: contents}
+		c.identity = "unknown (access token)"
+		return oauth2.StaticTokenSource(token), nil
+	}
+
+	if c.TokenCommand != "" {
+		log.Printf("[INFO] Authenticating using access tokens printed by %q...", c.TokenCommand)
+		log.Printf("[INFO]   -- Scopes: %s (the command decides the token's actual scopes)", clientScopes)
+		logScopeNotes(accessTokenScopes, c.scopesNarrowed())
+		c.identity = "unknown (token command)"
+		return newCommandTokenSource(ctx, c.TokenCommand, c.RequestTimeout)
+	}
+
+	// Without configured credentials, the file gcloud writes application
+	// default credentials to is used explicitly, so its path is reported;
+	// there are several places it could be.
+	credentials := c.Credentials
+	if credentials == "" {
+		if path, ok := wellKnownADCFile(); ok {
+			credentials = path
+			c.credentialsSource = path + ", the application default credentials file written by gcloud auth application-default login"
+		}
+	}
+
+	if credentials != "" {
+		contents, wasPath, err := pathorcontents.Read(credentials)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading credentials: %s", err)
+		}
+
+		// Never include the contents in errors, they may hold a private key.
+		from := "<inline>"
+		if wasPath {
+			from = credentials
+		}
+		file, err := parseCredentialsFile([]byte(contents))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse credentials from '%s': %s", from, err)
+		}
+		if err := validateCredentialsFile([]byte(contents)); err != nil {
+			return nil, fmt.Errorf("Invalid credentials from '%s': %s", from, err)
+		}
+		if c.Subject != "" {
+			return c.delegatedTokenSource(ctx, file, []byte(contents), from, clientScopes)
+		}
+		creds, err := googleoauth.CredentialsFromJSON(ctx, []byte(contents), clientScopes...)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse credentials from '%s': %s", from, err)
+		}
+		if err := c.checkUniverse(creds); err != nil {
+			return nil, fmt.Errorf("Credentials from '%s' can't be used: %s", from, err)
+		}
+
+		source := c.credentialsSource
+		if source == "" {
+			source = "Config.Credentials"
+		}
+		log.Printf("[INFO] Authenticating using configured Google JSON 'credentials' from %s...", source)
+		logCredentialsFile(file)
+		c.identity = describeIdentity(file)
+		log.Printf("[INFO]   -- Scopes: %s", clientScopes)
+		logScopeNotes(file.Type, c.scopesNarrowed())
+		if err := checkTokenURL(ctx, file); err != nil {
+			return nil, err
+		}
+		return creds.TokenSource, nil
+	}
+
+	log.Printf("[INFO] Authenticating using DefaultClient...")
+	if path := adcFilePath(); path != "" {
+		log.Printf("[INFO]   -- No application default credentials file at %s", path)
+	}
+	c.identity = "unknown (application default credentials)"
+	log.Printf("[INFO]   -- Scopes: %s", clientScopes)
+	creds, err := googleoauth.FindDefaultCredentials(ctx, clientScopes...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkUniverse(creds); err != nil {
+		return nil, fmt.Errorf("Application default credentials can't be used: %s", err)
+	}
+	// Application default credentials without JSON come from the metadata
+	// server.
+	typ := metadataScopes
+	if len(creds.JSON) > 0 {
+		if file, err := parseCredentialsFile(creds.JSON); err == nil {
+			typ = file.Type
+		}
+	}
+	logScopeNotes(typ, c.scopesNarrowed())
+	return creds.TokenSource, nil
+}
+
+// delegatedTokenSource returns a token source for the service account key
+// in contents that impersonates c.Subject with domain-wide delegation.
+func (c *Config) delegatedTokenSource(ctx context.Context, file credentialsFile, contents []byte, from string, clientScopes []string) (oauth2.TokenSource, error) {
+	if file.Type != serviceAccountKey {
+		return nil, fmt.Errorf("GOOGLE_SUBJECT was set, but the credentials from '%s' are %s credentials; domain-wide delegation needs a service account key", from, file.Type)
+	}
+	jwt, err := googleoauth.JWTConfigFromJSON(contents, clientScopes...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse credentials from '%s': %s", from, err)
+	}
+	jwt.Subject = c.Subject
+
+	log.Printf("[INFO] Authenticating using configured Google JSON 'credentials' with domain-wide delegation...")
+	logCredentialsFile(file)
+	log.Printf("[INFO]   -- Subject: %s", c.Subject)
+	log.Printf("[INFO]   -- Scopes: %s", clientScopes)
+	// With delegation, the scopes must each be authorized for the service
+	// account's client ID in the Workspace admin console, and they decide
+	// what the token can do.
+	c.identity = fmt.Sprintf("%s (delegated by %s)", c.Subject, file.ClientEmail)
+	return jwt.TokenSource(ctx), nil
+}
+
+// defaultUniverseDomain is the domain of the public Google Cloud universe.
+const defaultUniverseDomain = "googleapis.com"
+
+// inUniverse returns endpoint, a URL or host in the default universe, moved
+// to c's universe.
+func (c *Config) inUniverse(endpoint string) string {
+	if c.UniverseDomain == "" || c.UniverseDomain == defaultUniverseDomain {
+		return endpoint
+	}
+	return strings.Replace(endpoint, "."+defaultUniverseDomain, "."+c.UniverseDomain, 1)
+}
+
+// checkUniverse returns an error if creds are for a different universe
+// than c.
+func (c *Config) checkUniverse(creds *googleoauth.Credentials) error {
+	universe, err := creds.GetUniverseDomain()
+	if err != nil {
+		return fmt.Errorf("Error reading the credentials' universe domain: %s", err)
+	}
+	if universe != c.UniverseDomain {
+		return fmt.Errorf("they're for universe domain %q, but the universe domain is %q; set GOOGLE_CLOUD_UNIVERSE_DOMAIN to match", universe, c.UniverseDomain)
+	}
+	return nil
+}
+
+// scopesNarrowed reports whether scopes other than the defaults were
+// requested.
+func (c *Config) scopesNarrowed() bool {
+	return !slices.Equal(c.Scopes, defaultClientScopes)
+}
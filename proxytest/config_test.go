@@ -0,0 +1,188 @@
+package proxytest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a,b", []string{"a", "b"}},
+		{" a , ,b,, ", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := SplitList(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SplitList(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("GOOGLE_PROJECT", "my-project")
+	t.Setenv("GOOGLE_PROJECTS", "a, b")
+	t.Setenv("GCP_PROXY_URL", "http://proxy.example.com:3128")
+	t.Setenv("USER_PROJECT_OVERRIDE", "true")
+	t.Setenv("GCP_REQUEST_TIMEOUT", "5s")
+
+	conf, err := ConfigFromEnv(DefaultConfig())
+	if err != nil {
+		t.Fatalf("ConfigFromEnv: %s", err)
+	}
+	if conf.Project != "my-project" {
+		t.Errorf("Project = %q, want %q", conf.Project, "my-project")
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(conf.Projects, want) {
+		t.Errorf("Projects = %q, want %q", conf.Projects, want)
+	}
+	if conf.ProxyURL != "http://proxy.example.com:3128" {
+		t.Errorf("ProxyURL = %q, want %q", conf.ProxyURL, "http://proxy.example.com:3128")
+	}
+	if !conf.UserProjectOverride {
+		t.Error("UserProjectOverride = false, want true")
+	}
+	if conf.RequestTimeout != 5*time.Second {
+		t.Errorf("RequestTimeout = %s, want 5s", conf.RequestTimeout)
+	}
+	if conf.ConnectTimeout != defaultConnectTimeout {
+		t.Errorf("ConnectTimeout = %s, want the default %s", conf.ConnectTimeout, defaultConnectTimeout)
+	}
+}
+
+func TestConfigFromEnvCredentialsPrecedence(t *testing.T) {
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/adc.json")
+	t.Setenv("GOOGLE_CREDENTIALS", "/provider.json")
+
+	conf, err := ConfigFromEnv(DefaultConfig())
+	if err != nil {
+		t.Fatalf("ConfigFromEnv: %s", err)
+	}
+	if conf.Credentials != "/provider.json" || conf.credentialsSource != "GOOGLE_CREDENTIALS" {
+		t.Errorf("Credentials = %q from %s, want /provider.json from GOOGLE_CREDENTIALS", conf.Credentials, conf.credentialsSource)
+	}
+
+	t.Setenv("GOOGLE_CREDENTIALS_BASE64", base64.StdEncoding.EncodeToString([]byte(`{"type": "service_account"}`)))
+	conf, err = ConfigFromEnv(DefaultConfig())
+	if err != nil {
+		t.Fatalf("ConfigFromEnv: %s", err)
+	}
+	if conf.Credentials != `{"type": "service_account"}` || conf.credentialsSource != "GOOGLE_CREDENTIALS_BASE64" {
+		t.Errorf("Credentials = %q from %s, want the decoded GOOGLE_CREDENTIALS_BASE64", conf.Credentials, conf.credentialsSource)
+	}
+}
+
+func TestConfigFromEnvInvalid(t *testing.T) {
+	for k, v := range map[string]string{
+		"GOOGLE_CREDENTIALS_BASE64": "not base64!",
+		"USER_PROJECT_OVERRIDE":     "sometimes",
+		"GCP_CONNECT_TIMEOUT":       "5",
+	} {
+		t.Run(k, func(t *testing.T) {
+			t.Setenv(k, v)
+			if _, err := ConfigFromEnv(DefaultConfig()); err == nil || !strings.Contains(err.Error(), k) {
+				t.Errorf("ConfigFromEnv with %s=%q = %v, want an error naming %s", k, v, err, k)
+			}
+		})
+	}
+}
+
+func TestValidateScope(t *testing.T) {
+	if err := validateScope("https://www.googleapis.com/auth/cloud-platform"); err != nil {
+		t.Errorf("validateScope(cloud-platform URL) = %s, want nil", err)
+	}
+	if err := validateScope("cloud-platform"); err == nil {
+		t.Error("validateScope(cloud-platform) = nil, want an error")
+	}
+}
+
+func TestNormalizeEndpoint(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"https://cloudbilling.googleapis.com", "https://cloudbilling.googleapis.com/", false},
+		{"http://localhost:8080/", "http://localhost:8080/", false},
+		{"cloudbilling.googleapis.com", "", true},
+		{"ftp://example.com/", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeEndpoint(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeEndpoint(%q) = %q, %v, want %q, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNormalizeFolderParent(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"123", "organizations/123", false},
+		{"folders/456", "folders/456", false},
+		{"projects/my-project", "", true},
+		{"organizations/abc", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeFolderParent(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeFolderParent(%q) = %q, %v, want %q, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNormalizeOrgID(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"123456789012", "organizations/123456789012", false},
+		{" organizations/123456789012 ", "organizations/123456789012", false},
+		{"folders/456", "", true},
+		{"projects/my-project", "", true},
+		{"organizations/abc", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeOrgID(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeOrgID(%q) = %q, %v, want %q, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestNormalizeBillingAccount(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{"012345-6789ab-cdef01", "billingAccounts/012345-6789AB-CDEF01", false},
+		{"billingAccounts/012345-6789AB-CDEF01", "billingAccounts/012345-6789AB-CDEF01", false},
+		{"012345", "", true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeBillingAccount(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeBillingAccount(%q) = %q, %v, want %q, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestPrintVersion(t *testing.T) {
+	var buf bytes.Buffer
+	PrintVersion(&buf)
+	if !strings.HasPrefix(buf.String(), "gcp-proxy-test "+toolVersion+"\n") {
+		t.Errorf("PrintVersion wrote %q, want it to start with the tool version", buf.String())
+	}
+}
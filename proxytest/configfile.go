@@ -0,0 +1,45 @@
+package proxytest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfigFile reads the YAML or TOML config file at path into conf,
+// leaving any settings the file doesn't mention untouched. The format is
+// chosen by the file's extension, and unknown keys are an error so typos
+// don't silently fall back to defaults.
+func LoadConfigFile(path string, conf *Config) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(contents))
+		dec.KnownFields(true)
+		if err := dec.Decode(conf); err != nil {
+			return fmt.Errorf("Error parsing %s as YAML: %s", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(contents), conf)
+		if err != nil {
+			return fmt.Errorf("Error parsing %s as TOML: %s", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("Error parsing %s as TOML: unknown keys %s", path, undecoded)
+		}
+	default:
+		return fmt.Errorf("Unable to read %s: config files must have a .yaml, .yml, or .toml extension, not %q", path, ext)
+	}
+	if conf.Credentials != "" {
+		conf.credentialsSource = path
+	}
+	return nil
+}
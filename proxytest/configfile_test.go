@@ -0,0 +1,121 @@
+package proxytest
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes contents to a file called name in a temporary
+// directory, returning its path.
+func writeConfigFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name, contents string
+	}{
+		{"config.yaml", `
+project: my-project
+credentials: /path/to/key.json
+scopes:
+  - https://www.googleapis.com/auth/cloud-platform
+checks: [billing, storage]
+request_timeout: 10s
+retry_base_delay: 1m30s
+deadline: 2m
+check_timeouts:
+  billing: 45s
+  storage: 1m30s
+`},
+		{"config.yml", `
+project: my-project
+credentials: /path/to/key.json
+scopes: [https://www.googleapis.com/auth/cloud-platform]
+checks: [billing, storage]
+request_timeout: 10s
+retry_base_delay: 1m30s
+deadline: 2m
+check_timeouts: {billing: 45s, storage: 1m30s}
+`},
+		{"config.toml", `
+project = "my-project"
+credentials = "/path/to/key.json"
+scopes = ["https://www.googleapis.com/auth/cloud-platform"]
+checks = ["billing", "storage"]
+request_timeout = "10s"
+retry_base_delay = "1m30s"
+deadline = "2m"
+
+[check_timeouts]
+billing = "45s"
+storage = "1m30s"
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DefaultConfig()
+			path := writeConfigFile(t, tt.name, tt.contents)
+			if err := LoadConfigFile(path, &conf); err != nil {
+				t.Fatalf("LoadConfigFile: %s", err)
+			}
+			if conf.Project != "my-project" {
+				t.Errorf("Project = %q, want %q", conf.Project, "my-project")
+			}
+			if want := []string{"https://www.googleapis.com/auth/cloud-platform"}; !reflect.DeepEqual(conf.Scopes, want) {
+				t.Errorf("Scopes = %q, want %q", conf.Scopes, want)
+			}
+			if want := []string{"billing", "storage"}; !reflect.DeepEqual(conf.Checks, want) {
+				t.Errorf("Checks = %q, want %q", conf.Checks, want)
+			}
+			if conf.RequestTimeout != 10*time.Second {
+				t.Errorf("RequestTimeout = %s, want 10s", conf.RequestTimeout)
+			}
+			if conf.RetryBaseDelay != 90*time.Second {
+				t.Errorf("RetryBaseDelay = %s, want 1m30s", conf.RetryBaseDelay)
+			}
+			if conf.Deadline != 2*time.Minute {
+				t.Errorf("Deadline = %s, want 2m", conf.Deadline)
+			}
+			if want := map[string]time.Duration{"billing": 45 * time.Second, "storage": 90 * time.Second}; !reflect.DeepEqual(conf.CheckTimeouts, want) {
+				t.Errorf("CheckTimeouts = %v, want %v", conf.CheckTimeouts, want)
+			}
+			if conf.RetryMaxAttempts != defaultRetryMaxAttempts {
+				t.Errorf("RetryMaxAttempts = %d, want the untouched default %d", conf.RetryMaxAttempts, defaultRetryMaxAttempts)
+			}
+			if conf.credentialsSource != path {
+				t.Errorf("credentialsSource = %q, want the config file %q", conf.credentialsSource, path)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name, contents, want string
+	}{
+		{"typo.yaml", "projcet: my-project\n", "field projcet not found"},
+		{"typo.toml", "projcet = \"my-project\"\n", "unknown keys [projcet]"},
+		{"duration.yaml", "request_timeout: soon\n", "Error parsing"},
+		{"duration.toml", "request_timeout = \"soon\"\n", "Error parsing"},
+		{"config.json", "{}", "must have a .yaml, .yml, or .toml extension"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DefaultConfig()
+			err := LoadConfigFile(writeConfigFile(t, tt.name, tt.contents), &conf)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadConfigFile = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
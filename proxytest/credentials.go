@@ -0,0 +1,298 @@
+package proxytest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/oauth2"
+)
+
+// Credential types, from the "type" field of a credentials JSON file.
+const (
+	serviceAccountKey          = "service_account"
+	userCredentialsKey         = "authorized_user"
+	externalAccountKey         = "external_account"
+	impersonatedServiceAccount = "impersonated_service_account"
+	externalAccountUserKey     = "external_account_authorized_user"
+)
+
+// requiredCredentialFields are the fields each type of credentials file
+// can't work without.
+var requiredCredentialFields = map[string][]string{
+	serviceAccountKey:          {"client_email", "private_key"},
+	userCredentialsKey:         {"client_id", "client_secret", "refresh_token"},
+	externalAccountKey:         {"audience", "subject_token_type", "credential_source"},
+	impersonatedServiceAccount: {"service_account_impersonation_url", "source_credentials"},
+	externalAccountUserKey:     {"refresh_token", "token_url"},
+}
+
+// credentialsFile holds the fields of a credentials JSON file that are used
+// to describe and sanity check it.
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// service_account
+	ClientEmail string `json:"client_email"`
+
+	// external_account
+	Audience string `json:"audience"`
+	TokenURL string `json:"token_url"`
+
+	// external_account and impersonated_service_account
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+}
+
+// parseCredentialsFile parses the parts of contents that describe it.
+func parseCredentialsFile(contents []byte) (credentialsFile, error) {
+	var f credentialsFile
+	if err := json.Unmarshal(contents, &f); err != nil {
+		return f, fmt.Errorf("credentials are not valid JSON: %s", err)
+	}
+	return f, nil
+}
+
+// validateCredentialsFile checks that contents, which must be valid JSON,
+// are a known type of credentials with every field that type requires.
+func validateCredentialsFile(contents []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(contents, &fields); err != nil {
+		return fmt.Errorf("credentials must be a JSON object: %s", err)
+	}
+	var typ string
+	if err := json.Unmarshal(fields["type"], &typ); err != nil || typ == "" {
+		return fmt.Errorf("missing the \"type\" field")
+	}
+	required, ok := requiredCredentialFields[typ]
+	if !ok {
+		var known []string
+		for k := range requiredCredentialFields {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		return fmt.Errorf("unknown type %q; known types are %s", typ, strings.Join(known, ", "))
+	}
+	for _, field := range required {
+		if v, ok := fields[field]; !ok || string(v) == `""` || string(v) == "null" {
+			return fmt.Errorf("missing the %q field required for %s credentials", field, typ)
+		}
+	}
+	return nil
+}
+
+// logCredentialsFile logs the type of f, along with whatever it says about
+// the identity that will be used.
+func logCredentialsFile(f credentialsFile) {
+	switch f.Type {
+	case serviceAccountKey:
+		log.Printf("[INFO]   -- Credential type: service account key for %s", f.ClientEmail)
+	case userCredentialsKey:
+		log.Printf("[INFO]   -- Credential type: user credentials")
+	case externalAccountKey:
+		log.Printf("[INFO]   -- Credential type: external account (workload identity federation) for %s", f.Audience)
+		if f.ServiceAccountImpersonationURL != "" {
+			log.Printf("[INFO]   -- Impersonates: %s", f.ServiceAccountImpersonationURL)
+		}
+	case externalAccountUserKey:
+		log.Printf("[INFO]   -- Credential type: external account user credentials (workforce identity federation)")
+	case impersonatedServiceAccount:
+		log.Printf("[INFO]   -- Credential type: impersonated service account via %s", f.ServiceAccountImpersonationURL)
+	default:
+		log.Printf("[WARN]   -- Credential type: unrecognized type %q", f.Type)
+	}
+}
+
+// Pseudo credential types for logScopeNotes, for credentials that don't
+// come from a file.
+const (
+	accessTokenScopes = "access token"
+	metadataScopes    = "metadata server"
+)
+
+// logScopeNotes explains how credentials of type typ treat the requested
+// scopes, as not every type honors them, and warns if narrowing them with
+// GOOGLE_SCOPES won't have the expected effect. typ is a credentials file
+// type, or accessTokenScopes or metadataScopes.
+func logScopeNotes(typ string, narrowed bool) {
+	switch typ {
+	case serviceAccountKey:
+		if narrowed {
+			log.Printf("[WARN]   -- Scopes were narrowed, but a service account key is granted whatever it requests, and what it can do is decided by its IAM roles; to test a restricted account, grant it fewer roles instead")
+			return
+		}
+		log.Printf("[INFO]   -- Scope note: service account keys are granted the requested scopes; without domain-wide delegation, access is decided by the account's IAM roles")
+	case userCredentialsKey, externalAccountUserKey:
+		log.Printf("[INFO]   -- Scope note: user credentials are bound to the scopes granted when they were created, e.g. by gcloud auth application-default login; requesting others doesn't widen them")
+	case externalAccountKey, impersonatedServiceAccount:
+		log.Printf("[INFO]   -- Scope note: the requested scopes are passed on when exchanging or impersonating, and access is decided by the IAM roles of the final identity")
+	case accessTokenScopes:
+		if narrowed {
+			log.Printf("[WARN]   -- Scopes were narrowed, but an access token's scopes were fixed when it was minted, so they have no effect")
+			return
+		}
+		log.Printf("[INFO]   -- Scope note: an access token's scopes were fixed when it was minted; the requested scopes are ignored")
+	case metadataScopes:
+		if narrowed {
+			log.Printf("[WARN]   -- Scopes were narrowed, but metadata server tokens have the access scopes configured on the instance, so they have no effect")
+			return
+		}
+		log.Printf("[INFO]   -- Scope note: metadata server tokens have the access scopes configured on the instance; the requested scopes are ignored")
+	}
+}
+
+// describeIdentity returns who f authenticates as, as far as it says.
+func describeIdentity(f credentialsFile) string {
+	switch f.Type {
+	case serviceAccountKey:
+		return f.ClientEmail
+	case externalAccountKey:
+		if f.ServiceAccountImpersonationURL != "" {
+			return fmt.Sprintf("%s (federated, impersonating via %s)", f.Audience, f.ServiceAccountImpersonationURL)
+		}
+		return f.Audience + " (federated)"
+	case impersonatedServiceAccount:
+		return "impersonated via " + f.ServiceAccountImpersonationURL
+	}
+	return fmt.Sprintf("unknown (%s credentials)", f.Type)
+}
+
+// adcFilePath returns where gcloud auth application-default login writes
+// credentials: in the directory CLOUDSDK_CONFIG names, if it's set, and
+// otherwise in gcloud's default config directory. It returns "" if there's
+// no home directory to look in.
+func adcFilePath() string {
+	const file = "application_default_credentials.json"
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, file)
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("APPDATA"); dir != "" {
+			return filepath.Join(dir, "gcloud", file)
+		}
+		return ""
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", file)
+}
+
+// wellKnownADCFile returns the path of gcloud's application default
+// credentials file, and whether it exists.
+func wellKnownADCFile() (string, bool) {
+	path := adcFilePath()
+	if path == "" {
+		return "", false
+	}
+	_, err := os.Stat(path)
+	return path, err == nil
+}
+
+// checkTokenURL confirms that the token URL of external account credentials
+// can be reached through the transport in ctx. Federated credentials
+// exchange tokens with an STS endpoint that isn't one of the usual API
+// hosts, and is often missing from proxy allowlists. Any HTTP response at
+// all means the URL is reachable.
+func checkTokenURL(ctx context.Context, f credentialsFile) error {
+	if f.Type != externalAccountKey || f.TokenURL == "" {
+		return nil
+	}
+	client, ok := ctx.Value(oauth2.HTTPClient).(*http.Client)
+	if !ok {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(withoutResponseGuard(ctx), "GET", f.TokenURL, nil)
+	if err != nil {
+		return fmt.Errorf("Invalid external account token_url %q: %s", f.TokenURL, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("External account token_url %s is unreachable: %s", f.TokenURL, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// swapTokenSource is a TokenSource whose source can be replaced while
+// clients are using it.
+type swapTokenSource struct {
+	mu     sync.Mutex
+	source oauth2.TokenSource
+}
+
+func (s *swapTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	source := s.source
+	s.mu.Unlock()
+	return source.Token()
+}
+
+func (s *swapTokenSource) set(source oauth2.TokenSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.source = source
+}
+
+// reloadCredentials reads the credentials again, as LoadAndValidate did, and
+// mints a token with them, swapping them in for later requests. If they
+// can't be loaded, the previous credentials are kept. It returns a
+// description of the change if the identity they authenticate as changed,
+// or "" if it didn't.
+func (c *Config) reloadCredentials() string {
+	previous := c.identity
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, c.tokenClient)
+	source, err := c.getTokenSource(ctx, c.Scopes)
+	if err != nil {
+		c.identity = previous
+		log.Printf("[WARN] Error reloading credentials, still using the previous ones: %s", err)
+		return ""
+	}
+	// The count of tokens minted carries on from the previous credentials.
+	mints := &countingTokenSource{source: source}
+	mints.n.Store(c.mints.count())
+	reuse := oauth2.ReuseTokenSource(nil, mints)
+	token, err := reuse.Token()
+	if err != nil {
+		c.identity = previous
+		log.Printf("[WARN] Error retrieving a token with the reloaded credentials, still using the previous ones: %s", err)
+		return ""
+	}
+	c.mints = mints
+	c.tokenSource.set(reuse)
+	c.token = token
+
+	if c.identity == previous {
+		log.Printf("[INFO] Reloaded credentials, still authenticating as %s", c.identity)
+		return ""
+	}
+	change := fmt.Sprintf("identity changed from %s to %s", previous, c.identity)
+	log.Printf("[WARN] Reloaded credentials: %s", change)
+	return change
+}
+
+// countingTokenSource is a TokenSource that counts how many tokens it has
+// fetched from source.
+type countingTokenSource struct {
+	source oauth2.TokenSource
+	n      atomic.Int64
+}
+
+func (s *countingTokenSource) Token() (*oauth2.Token, error) {
+	s.n.Add(1)
+	return s.source.Token()
+}
+
+// count returns the number of tokens fetched so far.
+func (s *countingTokenSource) count() int64 {
+	return s.n.Load()
+}
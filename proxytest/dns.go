@@ -0,0 +1,20 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+)
+
+// checkDNS lists a managed zone in the configured project. The DNS endpoint
+// is sometimes subject to different proxy or firewall rules than the others,
+// so its failures name the endpoint explicitly.
+func checkDNS(ctx context.Context, c *Config) (string, error) {
+	if c.Project == "" {
+		return "", skip("no project configured; set GOOGLE_PROJECT")
+	}
+	_, err := c.clientDNS.ManagedZones.List(c.Project).MaxResults(1).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Error listing Cloud DNS managed zones in project %q via %s: %w", c.Project, c.clientDNS.BasePath, err)
+	}
+	return "", nil
+}
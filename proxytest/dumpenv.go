@@ -0,0 +1,87 @@
+package proxytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// credentialVars hold credentials, either as a path or the JSON itself.
+var credentialVars = map[string]bool{
+	"GOOGLE_CREDENTIALS":             true,
+	"GOOGLE_CREDENTIALS_BASE64":      true,
+	"GOOGLE_CLOUD_KEYFILE_JSON":      true,
+	"GOOGLE_KEYFILE_JSON":            true,
+	"GOOGLE_APPLICATION_CREDENTIALS": true,
+	"GOOGLE_OAUTH_ACCESS_TOKEN":      true,
+}
+
+// proxyVars are the variables that select a proxy, in either case.
+var proxyVars = map[string]bool{
+	"HTTP_PROXY":  true,
+	"HTTPS_PROXY": true,
+	"NO_PROXY":    true,
+	"ALL_PROXY":   true,
+}
+
+// DumpEnv writes every variable in environ that affects the tool, with
+// secrets redacted, in the given output format, for -dump-env. The result
+// is meant to be pasted into an issue.
+func DumpEnv(w io.Writer, format string, environ []string) error {
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		k, v, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(k, "GOOGLE_") || strings.HasPrefix(k, "GCP_") || k == "TF_LOG" || k == "CLOUDSDK_CONFIG" || proxyVars[strings.ToUpper(k)] {
+			vars[k] = redactEnv(k, v)
+		}
+	}
+
+	if format == OutputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(vars)
+	}
+
+	var names []string
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", k, vars[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redactEnv returns the value v of the variable k with any secrets masked.
+// Credentials are shown only if they're a path to a file, proxy URLs have
+// their passwords masked, and anything else that looks secret is masked.
+func redactEnv(k, v string) string {
+	upper := strings.ToUpper(k)
+	switch {
+	case credentialVars[k]:
+		if _, err := os.Stat(v); err == nil {
+			return v
+		}
+		return fmt.Sprintf("<redacted: %d bytes of inline contents>", len(v))
+	case proxyVars[upper] && upper != "NO_PROXY", k == "GCP_PROXY_URL":
+		if u, err := url.Parse(v); err == nil {
+			return u.Redacted()
+		}
+		return "<redacted: unparseable proxy URL>"
+	case k == "GCP_PROXY_USER" || k == "GCP_PROXY_PASSWORD":
+		return "<redacted>"
+	case strings.Contains(upper, "TOKEN") && upper != "GCP_TOKEN_COMMAND",
+		strings.Contains(upper, "SECRET"),
+		strings.Contains(upper, "PASSWORD"):
+		return "<redacted>"
+	}
+	return v
+}
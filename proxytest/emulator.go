@@ -0,0 +1,109 @@
+package proxytest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeToken is the access token sent with -fake-token, which no real
+// endpoint will accept.
+const fakeToken = "fake-token"
+
+// validateEmulator checks c.Emulator, the URL of a mock server that every
+// API and token info request is sent to instead of Google, returning it
+// without a trailing slash.
+func validateEmulator(emulator string) (string, error) {
+	u, err := url.Parse(emulator)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("%q must be the http or https URL of the emulator's root, e.g. http://localhost:8080", emulator)
+	}
+	log.Printf("[WARN] Sending every request to the emulator at %s: results only exercise the tool itself, and say nothing about reaching Google", emulator)
+	return strings.TrimSuffix(emulator, "/"), nil
+}
+
+// endpoint returns defaultURL, the URL of an endpoint in the default
+// universe, on the emulator if one is configured, or moved to c's
+// universe otherwise.
+func (c *Config) endpoint(defaultURL string) string {
+	if c.Emulator == "" {
+		return c.inUniverse(defaultURL)
+	}
+	u, err := url.Parse(defaultURL)
+	if err != nil {
+		return defaultURL
+	}
+	return c.Emulator + u.Path
+}
+
+// hostAddr returns the address HTTPS connections to host are made to: its
+// port 443, unless host is the emulator's, which is reached on whatever
+// port its URL names.
+func (c *Config) hostAddr(host string) string {
+	if u, err := url.Parse(c.Emulator); err == nil && c.Emulator != "" && u.Hostname() == host && u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(host, "443")
+}
+
+// plainEmulator reports whether requests go to an emulator over plain HTTP,
+// so there's no TLS to check.
+func (c *Config) plainEmulator() bool {
+	return strings.HasPrefix(c.Emulator, "http://")
+}
+
+// trustEmulator skips TLS verification of connections to the emulator
+// only, as emulators usually serve self-signed certificates. Connections to
+// any other host, e.g. a proxy, are verified as usual.
+func (c *Config) trustEmulator(config *tls.Config) error {
+	u, err := url.Parse(c.Emulator)
+	if err != nil || u.Scheme != "https" {
+		return err
+	}
+	if config.InsecureSkipVerify {
+		// Nothing is verified anyway.
+		return nil
+	}
+	emulatorHost := u.Hostname()
+	log.Printf("[WARN] Skipping TLS verification of the emulator at %s", emulatorHost)
+
+	// Connections to IP addresses send no server name, so an emulator at
+	// one is matched by the lack of a name instead.
+	if net.ParseIP(emulatorHost) != nil {
+		emulatorHost = ""
+	}
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if state.ServerName == emulatorHost {
+			return nil
+		}
+		opts := x509.VerifyOptions{
+			Roots:         config.RootCAs,
+			DNSName:       state.ServerName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := state.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	return nil
+}
+
+// fakeTokenSource returns a token source for -fake-token, which skips
+// authenticating entirely, for use with an emulator.
+func (c *Config) fakeTokenSource() oauth2.TokenSource {
+	log.Printf("[INFO] Authenticating using a fake access token...")
+	c.identity = "nobody (fake token)"
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: fakeToken})
+}
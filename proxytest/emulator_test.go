@@ -0,0 +1,48 @@
+package proxytest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEmulatorSkipsUnemulatedChecks(t *testing.T) {
+	conf := newTestConfig(t, http.NotFoundHandler(), func(c *Config) {
+		c.Checks = []string{"tls", "regional"}
+		c.Region = "us-central1"
+	})
+
+	report := conf.RunChecks(context.Background(), nil)
+	for _, name := range []string{"tls", "regional"} {
+		if r := resultOf(t, report, name); !r.Skipped {
+			t.Errorf("%s check = %+v, want it skipped with an emulator", name, r)
+		}
+	}
+
+	chains, ok := conf.certChains(context.Background())
+	if len(chains) != 0 || !ok {
+		t.Errorf("certChains = %+v, %t, want no chains from a plain HTTP emulator", chains, ok)
+	}
+}
+
+func TestEmulatorTLSUsesEmulatorPort(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	conf := loadTestConfig(t, srv.URL, func(c *Config) {
+		c.Checks = []string{"tls"}
+	})
+
+	r := resultOf(t, conf.RunChecks(context.Background(), nil), "tls")
+	if !r.Success {
+		t.Fatalf("tls check = %+v, want a handshake with the emulator", r)
+	}
+	if host := strings.TrimPrefix(srv.URL, "https://"); conf.hostAddr("127.0.0.1") != host {
+		t.Errorf("hostAddr(127.0.0.1) = %q, want the emulator's %q", conf.hostAddr("127.0.0.1"), host)
+	}
+	if addr := conf.hostAddr("www.googleapis.com"); addr != "www.googleapis.com:443" {
+		t.Errorf("hostAddr(www.googleapis.com) = %q, want port 443", addr)
+	}
+}
@@ -0,0 +1,229 @@
+package proxytest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Error categories, pointing at what most likely needs fixing.
+const (
+	CategoryAuthentication = "authentication"
+	CategoryAuthorization  = "authorization"
+	CategoryNetwork        = "network/proxy"
+	CategoryQuota          = "quota"
+	CategoryServer         = "server"
+	CategoryInterrupted    = "interrupted"
+	CategoryDeadline       = "deadline"
+	CategoryLatency        = "latency"
+	CategoryOther          = "other"
+)
+
+// categoryPrecedence orders the categories from the most fundamental
+// problem to the least, so a run that failed in several ways is explained
+// by the first: nothing works without a network path to Google, and
+// permissions don't matter until the credentials are accepted.
+var categoryPrecedence = []string{
+	CategoryNetwork,
+	CategoryAuthentication,
+	CategoryAuthorization,
+	CategoryQuota,
+	CategoryServer,
+	CategoryDeadline,
+	CategoryLatency,
+	CategoryInterrupted,
+	CategoryOther,
+}
+
+// Categories returns every error category, in order of precedence.
+func Categories() []string {
+	return slices.Clone(categoryPrecedence)
+}
+
+// FailureCategory returns the category that best explains why r failed:
+// of the categories of the failed attempts of the checks that failed, the
+// first in order of precedence, or a category of a registered check's own
+// if there are no others. It returns "" if no check failed.
+func (r Report) FailureCategory() string {
+	failed := failedSet(r)
+	best, custom := -1, ""
+	for _, result := range r.Results {
+		if result.Success || result.Skipped || !failed[result.Check] {
+			continue
+		}
+		i := slices.Index(categoryPrecedence, result.Category)
+		switch {
+		case i < 0:
+			custom = result.Category
+		case best < 0 || i < best:
+			best = i
+		}
+	}
+	if best >= 0 {
+		return categoryPrecedence[best]
+	}
+	return custom
+}
+
+// quotaReasons are the error reasons Google uses for 403s caused by quota
+// or rate limits rather than missing permissions.
+var quotaReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"quotaExceeded":         true,
+	"dailyLimitExceeded":    true,
+}
+
+// classifyError returns the category of err: authentication means the
+// credentials were rejected, authorization that they lack a permission,
+// network/proxy that no response came back from Google at all, quota that a
+// limit was hit, and server that Google failed to handle the request.
+func classifyError(err error) string {
+	if errors.Is(err, context.Canceled) {
+		return CategoryInterrupted
+	}
+	if category := resultCategory(err); category != "" {
+		return category
+	}
+
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		return CategoryAuthentication
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch {
+		case gerr.Code == 401:
+			return CategoryAuthentication
+		case gerr.Code == 429:
+			return CategoryQuota
+		case gerr.Code == 403:
+			for _, e := range gerr.Errors {
+				if quotaReasons[e.Reason] {
+					return CategoryQuota
+				}
+			}
+			return CategoryAuthorization
+		case gerr.Code >= 500:
+			return CategoryServer
+		}
+		return CategoryOther
+	}
+
+	// Certificates that can't be verified usually mean a proxy is
+	// intercepting TLS.
+	var verr *tls.CertificateVerificationError
+	if isNetworkError(err) || errors.As(err, &verr) {
+		return CategoryNetwork
+	}
+	return CategoryOther
+}
+
+// describeError returns err's message, with any Google API error in it
+// spelled out: the reason, domain, and message of each of its sub-errors,
+// rather than the flat string the client library produces. Errors that mean
+// the API isn't enabled get a hint on enabling it.
+func describeError(err error) string {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) || (len(gerr.Errors) == 0 && len(gerr.Details) == 0) {
+		return err.Error()
+	}
+
+	// The client library drops each sub-error's domain, so it's read from
+	// the response body.
+	var body struct {
+		Error struct {
+			Errors []struct {
+				Domain string `json:"domain"`
+			} `json:"errors"`
+		} `json:"error"`
+	}
+	json.Unmarshal([]byte(gerr.Body), &body)
+
+	var parts []string
+	disabled := false
+	for i, e := range gerr.Errors {
+		part := "[reason " + e.Reason
+		if i < len(body.Error.Errors) && body.Error.Errors[i].Domain != "" {
+			part += ", domain " + body.Error.Errors[i].Domain
+		}
+		parts = append(parts, part+": "+e.Message+"]")
+		disabled = disabled || e.Reason == "accessNotConfigured"
+	}
+	if len(parts) == 0 {
+		parts = append(parts, gerr.Message)
+	}
+	var service string
+	for _, detail := range gerr.Details {
+		d, ok := detail.(map[string]interface{})
+		if !ok || d["@type"] != "type.googleapis.com/google.rpc.ErrorInfo" {
+			continue
+		}
+		if d["reason"] == "SERVICE_DISABLED" {
+			disabled = true
+			if metadata, ok := d["metadata"].(map[string]interface{}); ok {
+				service, _ = metadata["service"].(string)
+			}
+		}
+	}
+
+	described := fmt.Sprintf("HTTP %d %s", gerr.Code, strings.Join(parts, " "))
+	if disabled {
+		if service == "" {
+			service = "<api>.googleapis.com"
+		}
+		described += fmt.Sprintf("; the API isn't enabled on the project, enable it with: gcloud services enable %s", service)
+	}
+	return strings.Replace(err.Error(), gerr.Error(), described, 1)
+}
+
+// logQuotaDetails logs, at debug level, what the response that caused err
+// says about quotas: how long to wait before retrying, and which quota or
+// limit was hit, e.g. to tell a per-minute limit from a per-day one.
+func logQuotaDetails(check string, err error) {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return
+	}
+	logRateLimitHeaders(check, gerr.Header)
+	for _, detail := range gerr.Details {
+		d, ok := detail.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		switch d["@type"] {
+		case "type.googleapis.com/google.rpc.RetryInfo":
+			log.Printf("[DEBUG] %s: retry info: retry after %v", check, d["retryDelay"])
+		case "type.googleapis.com/google.rpc.QuotaFailure":
+			violations, _ := d["violations"].([]interface{})
+			for _, v := range violations {
+				log.Printf("[DEBUG] %s: quota violation: %v", check, v)
+			}
+		case "type.googleapis.com/google.rpc.ErrorInfo":
+			if metadata, ok := d["metadata"].(map[string]interface{}); ok && len(metadata) > 0 {
+				log.Printf("[DEBUG] %s: error info %v: %v", check, d["reason"], metadata)
+			}
+		}
+	}
+}
+
+// logRateLimitHeaders logs, at debug level, any headers in header that
+// describe rate limits.
+func logRateLimitHeaders(check string, header http.Header) {
+	for name, values := range header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-ratelimit-") || strings.Contains(lower, "quota") || lower == "retry-after" {
+			log.Printf("[DEBUG] %s: %s: %s", check, name, strings.Join(values, ", "))
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package proxytest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// tokenInfoURL describes access tokens issued by Google, and tokenURL
+// issues them, in the default universe.
+const (
+	tokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+	tokenURL     = "https://oauth2.googleapis.com/token"
+)
+
+// checkIdentity asks Google who the token being used belongs to, which is
+// the definitive answer even when several credentials or impersonation are
+// involved. The email is only included in the response if the token has the
+// userinfo.email scope; otherwise the identity is taken from the credentials.
+// The scopes the token was granted are compared to those requested; a token
+// missing one, as happens with user credentials consented to fewer scopes,
+// gets 403s from the APIs that need it even though others work.
+func checkIdentity(ctx context.Context, c *Config) (string, error) {
+	token, err := c.tokenSource.Token()
+	if err != nil {
+		return "", fmt.Errorf("Error retrieving token: %w", err)
+	}
+
+	// The token is sent in the body rather than the URL, so it doesn't end
+	// up in proxy logs.
+	body := url.Values{"access_token": {token.AccessToken}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "POST", c.endpoint(tokenInfoURL), strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", c.userAgent)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error reading token info: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Error reading token info: %s", resp.Status)
+	}
+
+	var info struct {
+		Email string `json:"email"`
+		AZP   string `json:"azp"`
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("Error parsing token info: %s", err)
+	}
+	detail := fmt.Sprintf("authenticated as %s, client %s (add the userinfo.email scope to confirm the email)", c.identity, info.AZP)
+	if info.Email != "" {
+		detail = "authenticated as " + info.Email
+	}
+
+	if info.Scope == "" {
+		return detail, nil
+	}
+	granted := strings.Fields(info.Scope)
+	missing, extra := diffScopes(c.Scopes, granted)
+	if len(missing) > 0 {
+		log.Printf("[WARN] The token wasn't granted every requested scope; APIs needing these will fail with 403s: %s", strings.Join(missing, ", "))
+		detail += fmt.Sprintf("; granted %d of %d requested scopes, missing %s", len(c.Scopes)-len(missing), len(c.Scopes), strings.Join(missing, ", "))
+	} else {
+		detail += fmt.Sprintf("; granted all %d requested scopes", len(c.Scopes))
+	}
+	if len(extra) > 0 {
+		detail += ", plus unrequested " + strings.Join(extra, ", ")
+	}
+	return detail, nil
+}
+
+// diffScopes returns the scopes in requested that weren't granted, and
+// those granted that weren't requested.
+func diffScopes(requested, granted []string) (missing, extra []string) {
+	for _, scope := range requested {
+		if !slices.Contains(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	for _, scope := range granted {
+		if !slices.Contains(requested, scope) {
+			extra = append(extra, scope)
+		}
+	}
+	return missing, extra
+}
@@ -0,0 +1,99 @@
+package proxytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/logutils"
+	"github.com/hashicorp/terraform/helper/logging"
+)
+
+// Log formats for diagnostic output on stderr.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// SetLogOutput filters diagnostic log lines by their [LEVEL] prefix using
+// the same levels as Terraform. [INFO] and above are shown by default;
+// level, TF_LOG, or debug select a different minimum level, and debug levels
+// also turn on request and response dumping in the transport. In the json
+// format, each line is written as a JSON object with a timestamp and level.
+func SetLogOutput(debug bool, level, format string) error {
+	if level != "" {
+		level = strings.ToUpper(level)
+		if !validLogLevel(level) {
+			return fmt.Errorf("Unknown log level %q; valid levels are %s", level, logging.ValidLevels)
+		}
+		os.Setenv(logging.EnvLog, level)
+	}
+	if debug {
+		os.Setenv(logging.EnvLog, "DEBUG")
+	}
+
+	var w io.Writer = os.Stderr
+	switch format {
+	case LogFormatText:
+	case LogFormatJSON:
+		log.SetFlags(0)
+		w = &jsonLogWriter{w: os.Stderr}
+	default:
+		return fmt.Errorf("Unknown log format %q; valid formats are %q and %q", format, LogFormatText, LogFormatJSON)
+	}
+
+	minLevel := logutils.LogLevel("INFO")
+	if level := logging.LogLevel(); level != "" {
+		minLevel = logutils.LogLevel(level)
+	}
+	log.SetOutput(&logutils.LevelFilter{
+		Levels:   logging.ValidLevels,
+		MinLevel: minLevel,
+		Writer:   w,
+	})
+	return nil
+}
+
+func validLogLevel(level string) bool {
+	for _, l := range logging.ValidLevels {
+		if string(l) == level {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonLogWriter writes each log line it's given as a JSON object, taking
+// the level from the line's [LEVEL] prefix.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (j *jsonLogWriter) Write(p []byte) (int, error) {
+	line := string(bytes.TrimRight(p, "\n"))
+	var level string
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "]"); end > 0 {
+			level = line[1:end]
+			line = strings.TrimSpace(line[end+1:])
+		}
+	}
+
+	entry, err := json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		Level   string    `json:"level,omitempty"`
+		Message string    `json:"message"`
+	}{time.Now().UTC(), level, line})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := j.w.Write(append(entry, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,38 @@
+package proxytest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+// checkMetadata asks the GCE metadata server, which provides ADC on GCE,
+// GKE, and Cloud Run, for the default service account and a token for it.
+// It talks to the metadata server directly, never through a proxy, since
+// that's how the client libraries reach it.
+func checkMetadata(ctx context.Context, c *Config) (string, error) {
+	if !metadata.OnGCEWithContext(ctx) {
+		return "", skip("not running on GCP, or the metadata server is unreachable")
+	}
+
+	email, err := metadata.EmailWithContext(ctx, "default")
+	if err != nil {
+		return "", fmt.Errorf("Error reading the default service account from the metadata server: %w", err)
+	}
+
+	raw, err := metadata.GetWithContext(ctx, "instance/service-accounts/default/token")
+	if err != nil {
+		return "", fmt.Errorf("Error retrieving a token for %s from the metadata server: %w", email, err)
+	}
+	var token struct {
+		TokenType string `json:"token_type"`
+		ExpiresIn int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(raw), &token); err != nil {
+		return "", fmt.Errorf("Error parsing the token for %s from the metadata server: %s", email, err)
+	}
+	return fmt.Sprintf("default service account %s, %s token expiring in %s", email, token.TokenType, time.Duration(token.ExpiresIn)*time.Second), nil
+}
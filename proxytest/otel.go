@@ -0,0 +1,78 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer of the spans around each check's calls.
+const tracerName = "github.com/paddycarver/gcp-proxy-test"
+
+// setupTracing exports spans over OTLP/HTTP to the collector at endpoint,
+// e.g. http://localhost:4318, and propagates trace context in requests.
+// Until it's called, spans are discarded.
+func (c *Config) setupTracing(endpoint string) error {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return fmt.Errorf("Error creating OTLP exporter for %s: %s", endpoint, err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("gcp-proxy-test")))
+	if err != nil {
+		return fmt.Errorf("Error describing the tracing resource: %s", err)
+	}
+	c.tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(c.tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	log.Printf("[INFO] Exporting traces to %s", endpoint)
+	return nil
+}
+
+// startCallSpan starts a span around a single call of the check called
+// name, as part of the given attempt.
+func startCallSpan(ctx context.Context, name string, attempt int) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "check "+name, trace.WithAttributes(
+		attribute.String("check.name", name),
+		attribute.Int("check.attempt", attempt),
+	))
+}
+
+// endCallSpan records the outcome of a call on span and ends it.
+func endCallSpan(span trace.Span, elapsed time.Duration, err error) {
+	span.SetAttributes(attribute.Int64("check.duration_ms", elapsed.Milliseconds()))
+	if status := httpStatus(err); status != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+	}
+	if err != nil {
+		span.SetAttributes(attribute.String("check.status", "error"), attribute.String("check.category", classifyError(err)))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(attribute.String("check.status", "ok"))
+	}
+	span.End()
+}
+
+// flushTraces exports any spans that haven't been yet, so none are lost if
+// the process exits.
+func (c *Config) flushTraces() {
+	if c.tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.tracerProvider.ForceFlush(ctx); err != nil {
+		log.Printf("[WARN] Error exporting traces: %s", err)
+	}
+}
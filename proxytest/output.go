@@ -0,0 +1,556 @@
+package proxytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Result is the outcome of a single attempt of a check.
+type Result struct {
+	Check      string `json:"check"`
+	Attempt    int    `json:"attempt"`
+	Success    bool   `json:"success"`
+	Skipped    bool   `json:"skipped,omitempty"`
+	SkipReason string `json:"skipReason,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Category   string `json:"category,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	Tries      int    `json:"tries"`
+	DurationMs int64  `json:"durationMs"`
+	BackoffMs  int64  `json:"backoffMs"`
+}
+
+// RetrySummary totals the requests made by a check's attempts, how many of
+// them were retries, and the time spent backing off between them.
+type RetrySummary struct {
+	Check     string `json:"check"`
+	Requests  int    `json:"requests"`
+	Retries   int    `json:"retries"`
+	BackoffMs int64  `json:"backoffMs"`
+}
+
+// summarizeRetries returns a RetrySummary for each check in results that
+// made any requests, in the order they appear.
+func summarizeRetries(results []Result) []RetrySummary {
+	var summaries []RetrySummary
+	index := make(map[string]int)
+	for _, r := range results {
+		if r.Tries == 0 {
+			continue
+		}
+		i, ok := index[r.Check]
+		if !ok {
+			i = len(summaries)
+			index[r.Check] = i
+			summaries = append(summaries, RetrySummary{Check: r.Check})
+		}
+		summaries[i].Requests += r.Tries
+		summaries[i].Retries += r.Tries - 1
+		summaries[i].BackoffMs += r.BackoffMs
+	}
+	return summaries
+}
+
+// ThresholdResult is how many of a check's attempts succeeded, and whether
+// that met the number required to pass.
+type ThresholdResult struct {
+	Check     string `json:"check"`
+	Succeeded int    `json:"succeeded"`
+	Attempts  int    `json:"attempts"`
+	Required  int    `json:"required"`
+	Met       bool   `json:"met"`
+}
+
+// summarizeThresholds returns a ThresholdResult for each check in results
+// that made any attempts, in the order they appear, requiring required of
+// them to succeed.
+func summarizeThresholds(results []Result, required int) []ThresholdResult {
+	var summaries []ThresholdResult
+	index := make(map[string]int)
+	for _, r := range results {
+		if r.Skipped {
+			continue
+		}
+		i, ok := index[r.Check]
+		if !ok {
+			i = len(summaries)
+			index[r.Check] = i
+			summaries = append(summaries, ThresholdResult{Check: r.Check, Required: required})
+		}
+		summaries[i].Attempts++
+		if r.Success {
+			summaries[i].Succeeded++
+		}
+		summaries[i].Met = summaries[i].Succeeded >= required
+	}
+	return summaries
+}
+
+// Report is the outcome of a whole run.
+type Report struct {
+	// Credentials and Project identify the credentials or project used
+	// when comparing several.
+	Credentials string `json:"credentials,omitempty"`
+	Project     string `json:"project,omitempty"`
+	// Error is set if the config couldn't be loaded, so no checks ran.
+	Error   string         `json:"error,omitempty"`
+	Success bool           `json:"success"`
+	Results []Result       `json:"results"`
+	Retries []RetrySummary `json:"retries,omitempty"`
+	// Thresholds are set when checks pass with enough successful attempts,
+	// rather than only if all of them succeed.
+	Thresholds []ThresholdResult `json:"thresholds,omitempty"`
+	// Connections counts how many requests to each host reused a pooled
+	// connection.
+	Connections []ConnectionReuse `json:"connections,omitempty"`
+}
+
+// Reporter presents results as a run progresses.
+type Reporter interface {
+	ConfigLoaded()
+	StartCheck(label string)
+	Attempt(r Result)
+	EndCheck(results []Result)
+	Finish(report Report) error
+
+	// Section and Compare are used instead of Finish when checks are run
+	// several times, e.g. with different credentials: Section introduces
+	// each run, and Compare reports them all side by side.
+	Section(title string)
+	Compare(reports []Report) error
+}
+
+// latency returns the minimum, average, and maximum duration of the
+// attempts in results that made a call. ok is false if none did.
+func latency(results []Result) (min, avg, max time.Duration, ok bool) {
+	var total time.Duration
+	var n int
+	for _, r := range results {
+		if r.Skipped {
+			continue
+		}
+		d := time.Duration(r.DurationMs) * time.Millisecond
+		if n == 0 || d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+		total += d
+		n++
+	}
+	if n == 0 {
+		return 0, 0, 0, false
+	}
+	return min, total / time.Duration(n), max, true
+}
+
+const (
+	OutputText  = "text"
+	OutputJSON  = "json"
+	OutputJSONL = "jsonl"
+)
+
+// NewReporter returns a Reporter for format writing to w. Text output is
+// colored if color is set.
+func NewReporter(format string, w io.Writer, color bool) (Reporter, error) {
+	switch format {
+	case OutputText:
+		return &textReporter{w: w, color: color}, nil
+	case OutputJSON:
+		return &jsonReporter{w: w}, nil
+	case OutputJSONL:
+		return &jsonlReporter{w: w}, nil
+	}
+	return nil, fmt.Errorf("Unknown output format %q; valid formats are %q, %q, and %q", format, OutputText, OutputJSON, OutputJSONL)
+}
+
+// textReporter prints a line per check, with a mark per attempt, as the run
+// progresses.
+type textReporter struct {
+	w     io.Writer
+	color bool
+}
+
+// ANSI escape codes for coloring text output.
+const (
+	ansiRed    = "\033[31m"
+	ansiGreen  = "\033[32m"
+	ansiYellow = "\033[33m"
+	ansiReset  = "\033[0m"
+)
+
+// paint returns s in the given color, if color is enabled.
+func (t *textReporter) paint(color, s string) string {
+	if !t.color {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+func (t *textReporter) ConfigLoaded() {
+	fmt.Fprintln(t.w, "Config successfully loaded ✅")
+}
+
+func (t *textReporter) StartCheck(label string) {
+	fmt.Fprintf(t.w, "Trying %s... ", label)
+}
+
+func (t *textReporter) Attempt(r Result) {
+	if r.Skipped {
+		fmt.Fprint(t.w, t.paint(ansiYellow, "⏭️  skipped: "+r.SkipReason))
+		return
+	}
+	var tries string
+	if r.Tries > 1 {
+		tries = fmt.Sprintf(" (%d tries)", r.Tries)
+	}
+	if !r.Success {
+		fmt.Fprint(t.w, t.paint(ansiRed, "‼️  ["+r.Category+"] "+r.Error+tries))
+		return
+	}
+	fmt.Fprint(t.w, t.paint(ansiGreen, "✅"+tries))
+}
+
+func (t *textReporter) EndCheck(results []Result) {
+	// Details rarely change between attempts, so only the last is shown.
+	if n := len(results); n > 0 && results[n-1].Detail != "" {
+		fmt.Fprint(t.w, " "+results[n-1].Detail)
+	}
+	if min, avg, max, ok := latency(results); ok {
+		fmt.Fprintf(t.w, " (latency min %s, avg %s, max %s)", min, avg, max)
+	}
+	fmt.Fprintln(t.w, "")
+}
+
+// Finish prints how many attempts of each check succeeded if they're
+// measured against a threshold, and how many requests and retries each
+// check made; many retries before an eventual success point at a flaky
+// network path. It then prints how many requests to each host reused a
+// connection; few reused behind a proxy point at it closing connections.
+func (t *textReporter) Finish(report Report) error {
+	if len(report.Thresholds) > 0 {
+		fmt.Fprintln(t.w, "\nFail threshold:")
+		for _, s := range report.Thresholds {
+			line := fmt.Sprintf("  %s: %d of %d attempts succeeded (%.0f%%), ", s.Check, s.Succeeded, s.Attempts, 100*float64(s.Succeeded)/float64(s.Attempts))
+			if s.Met {
+				line = t.paint(ansiGreen, line+fmt.Sprintf("meeting the threshold of %d", s.Required))
+			} else {
+				line = t.paint(ansiRed, line+fmt.Sprintf("short of the threshold of %d", s.Required))
+			}
+			fmt.Fprintln(t.w, line)
+		}
+	}
+	if len(report.Retries) > 0 {
+		fmt.Fprintln(t.w, "\nRetry budget:")
+		for _, s := range report.Retries {
+			backoff := time.Duration(s.BackoffMs) * time.Millisecond
+			fmt.Fprintf(t.w, "  %s: %d requests, %d retries, %s backing off\n", s.Check, s.Requests, s.Retries, backoff)
+		}
+	}
+	if len(report.Connections) > 0 {
+		fmt.Fprintln(t.w, "\nConnection reuse:")
+		for _, r := range report.Connections {
+			fmt.Fprintf(t.w, "  %s: %d of %d requests reused a connection (%.0f%%)\n", r.Host, r.Reused, r.Requests, 100*float64(r.Reused)/float64(r.Requests))
+		}
+	}
+	return nil
+}
+
+func (t *textReporter) Section(title string) {
+	fmt.Fprintf(t.w, "\n=== %s ===\n", title)
+}
+
+// Compare prints a matrix with a row per check and a column per run.
+// Checks that no run selected are left out.
+func (t *textReporter) Compare(reports []Report) error {
+	tw := tabwriter.NewWriter(t.w, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "\ncheck")
+	for _, report := range reports {
+		fmt.Fprint(tw, "\t"+report.title())
+	}
+	fmt.Fprintln(tw)
+
+	for _, chk := range checks {
+		var outcomes []string
+		selected := false
+		for _, report := range reports {
+			o := outcome(report, chk.name)
+			selected = selected || o != "not selected"
+			outcomes = append(outcomes, o)
+		}
+		if selected {
+			fmt.Fprintln(tw, chk.name+"\t"+strings.Join(outcomes, "\t"))
+		}
+	}
+	return tw.Flush()
+}
+
+// title identifies what report was run with when comparing several.
+func (r Report) title() string {
+	if r.Credentials != "" {
+		return r.Credentials
+	}
+	return r.Project
+}
+
+// outcome summarizes the result of the check called name in report.
+func outcome(report Report, name string) string {
+	if report.Error != "" {
+		return "config error"
+	}
+	outcome := "not run"
+	for _, r := range report.Results {
+		if r.Check != name {
+			continue
+		}
+		switch {
+		case r.Skipped && r.SkipReason == notSelected:
+			return "not selected"
+		case r.Skipped:
+			return "skipped"
+		}
+		outcome = "passed"
+	}
+	if outcome == "passed" && failedSet(report)[name] {
+		return "FAILED"
+	}
+	return outcome
+}
+
+// quietReporter prints nothing but a single line once the run is finished,
+// saying whether it passed, and which checks failed if not.
+type quietReporter struct {
+	w io.Writer
+}
+
+// NewQuietReporter returns a Reporter that writes only a single line to w
+// once the run is finished.
+func NewQuietReporter(w io.Writer) Reporter {
+	return &quietReporter{w: w}
+}
+
+func (q *quietReporter) ConfigLoaded()     {}
+func (q *quietReporter) StartCheck(string) {}
+func (q *quietReporter) Attempt(Result)    {}
+func (q *quietReporter) EndCheck([]Result) {}
+func (q *quietReporter) Section(string)    {}
+
+func (q *quietReporter) Finish(report Report) error {
+	_, err := fmt.Fprintln(q.w, summarize(report))
+	return err
+}
+
+func (q *quietReporter) Compare(reports []Report) error {
+	for _, report := range reports {
+		if _, err := fmt.Fprintf(q.w, "%s: %s\n", report.title(), summarize(report)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summarize describes report in a single line.
+func summarize(report Report) string {
+	if report.Error != "" {
+		return "FAIL: " + report.Error
+	}
+	if failed := failedChecks(report); len(failed) > 0 {
+		return "FAIL: " + strings.Join(failed, ", ")
+	}
+	return "PASS"
+}
+
+// failedChecks returns the names of the checks that failed in report: those
+// short of their threshold if there is one, and otherwise those with any
+// failed attempt.
+func failedChecks(report Report) []string {
+	var failed []string
+	if len(report.Thresholds) > 0 {
+		for _, s := range report.Thresholds {
+			if !s.Met {
+				failed = append(failed, s.Check)
+			}
+		}
+		return failed
+	}
+	for _, r := range report.Results {
+		if !r.Success && !r.Skipped && (len(failed) == 0 || failed[len(failed)-1] != r.Check) {
+			failed = append(failed, r.Check)
+		}
+	}
+	return failed
+}
+
+// recorder is a Reporter that records a check's output so it can be
+// replayed to another Reporter later.
+type recorder struct {
+	events []func(Reporter)
+}
+
+func (r *recorder) ConfigLoaded()           {}
+func (r *recorder) Finish(Report) error     { return nil }
+func (r *recorder) Section(string)          {}
+func (r *recorder) Compare([]Report) error  { return nil }
+func (r *recorder) StartCheck(label string) { r.record(func(out Reporter) { out.StartCheck(label) }) }
+func (r *recorder) Attempt(result Result)   { r.record(func(out Reporter) { out.Attempt(result) }) }
+func (r *recorder) EndCheck(results []Result) {
+	r.record(func(out Reporter) { out.EndCheck(results) })
+}
+
+func (r *recorder) record(event func(Reporter)) {
+	r.events = append(r.events, event)
+}
+
+// replay reports everything recorded to out.
+func (r *recorder) replay(out Reporter) {
+	for _, event := range r.events {
+		event(out)
+	}
+}
+
+// jsonReporter prints nothing until the run is finished, then prints the
+// whole report as a single JSON object.
+type jsonReporter struct {
+	w io.Writer
+}
+
+func (j *jsonReporter) ConfigLoaded()     {}
+func (j *jsonReporter) StartCheck(string) {}
+func (j *jsonReporter) Attempt(Result)    {}
+func (j *jsonReporter) EndCheck([]Result) {}
+
+func (j *jsonReporter) Section(string) {}
+
+func (j *jsonReporter) Finish(report Report) error {
+	return j.encode(report)
+}
+
+func (j *jsonReporter) Compare(reports []Report) error {
+	success := true
+	for _, report := range reports {
+		success = success && report.Success
+	}
+	return j.encode(struct {
+		Success bool     `json:"success"`
+		Runs    []Report `json:"runs"`
+	}{success, reports})
+}
+
+func (j *jsonReporter) encode(v interface{}) error {
+	enc := json.NewEncoder(j.w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// jsonlReporter prints a JSON object per line as soon as there's something
+// to report: one per attempt of a check, and one per finished run, so long
+// runs can be consumed as they progress.
+type jsonlReporter struct {
+	w io.Writer
+}
+
+func (j *jsonlReporter) ConfigLoaded()     {}
+func (j *jsonlReporter) StartCheck(string) {}
+func (j *jsonlReporter) EndCheck([]Result) {}
+
+func (j *jsonlReporter) Attempt(r Result) {
+	j.encode(struct {
+		Type string    `json:"type"`
+		Time time.Time `json:"time"`
+		Result
+	}{"result", time.Now(), r})
+}
+
+func (j *jsonlReporter) Finish(report Report) error {
+	return j.encode(struct {
+		Type         string            `json:"type"`
+		Time         time.Time         `json:"time"`
+		Title        string            `json:"title,omitempty"`
+		Success      bool              `json:"success"`
+		Error        string            `json:"error,omitempty"`
+		FailedChecks []string          `json:"failedChecks,omitempty"`
+		Thresholds   []ThresholdResult `json:"thresholds,omitempty"`
+	}{"run", time.Now(), report.title(), report.Success, report.Error, failedChecks(report), report.Thresholds})
+}
+
+func (j *jsonlReporter) Section(title string) {
+	j.encode(struct {
+		Type  string    `json:"type"`
+		Time  time.Time `json:"time"`
+		Title string    `json:"title"`
+	}{"section", time.Now(), title})
+}
+
+// Compare prints a line per run; each run's results have already been
+// printed as they came.
+func (j *jsonlReporter) Compare(reports []Report) error {
+	for _, report := range reports {
+		if err := j.Finish(report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *jsonlReporter) encode(v interface{}) error {
+	enc := json.NewEncoder(j.w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// teeReporter reports to every Reporter in turn.
+type teeReporter []Reporter
+
+func (t teeReporter) ConfigLoaded() {
+	for _, out := range t {
+		out.ConfigLoaded()
+	}
+}
+
+func (t teeReporter) StartCheck(label string) {
+	for _, out := range t {
+		out.StartCheck(label)
+	}
+}
+
+func (t teeReporter) Attempt(r Result) {
+	for _, out := range t {
+		out.Attempt(r)
+	}
+}
+
+func (t teeReporter) EndCheck(results []Result) {
+	for _, out := range t {
+		out.EndCheck(results)
+	}
+}
+
+func (t teeReporter) Finish(report Report) error {
+	for _, out := range t {
+		if err := out.Finish(report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t teeReporter) Section(title string) {
+	for _, out := range t {
+		out.Section(title)
+	}
+}
+
+func (t teeReporter) Compare(reports []Report) error {
+	for _, out := range t {
+		if err := out.Compare(reports); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package proxytest
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// configSetting is a resolved setting, named by its config file key.
+type configSetting struct {
+	key   string
+	value interface{}
+}
+
+// effectiveConfig returns every setting of c, in the order of the Config
+// struct, followed by what LoadAndValidate derived from them. Secrets are
+// redacted the same way as by -dump-env.
+func (c *Config) effectiveConfig() []configSetting {
+	var settings []configSetting
+	v := reflect.ValueOf(*c)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		settings = append(settings, configSetting{key, c.redactSetting(field.Name, v.Field(i).Interface())})
+	}
+
+	source := c.credentialsSource
+	if source == "" && c.Credentials != "" {
+		source = "Config.Credentials"
+	}
+	settings = append(settings,
+		configSetting{"credentials_source", source},
+		configSetting{"identity", c.identity},
+		configSetting{"endpoints", []string{
+			c.clientBilling.BasePath,
+			c.clientResourceManager.BasePath,
+			c.clientResourceManagerV2.BasePath,
+			c.clientCompute.BasePath,
+			c.clientStorage.BasePath,
+			c.clientDNS.BasePath,
+		}},
+	)
+	return settings
+}
+
+// redactSetting returns value, the value of the Config field called name,
+// with any secrets masked.
+func (c *Config) redactSetting(name string, value interface{}) interface{} {
+	switch name {
+	case "Credentials":
+		if c.Credentials == "" {
+			return ""
+		}
+		return redactEnv("GOOGLE_CREDENTIALS", c.Credentials)
+	case "AccessToken", "ProxyUser", "ProxyPassword":
+		if value == "" {
+			return ""
+		}
+		return "<redacted>"
+	case "TokenCommand":
+		// Arguments can carry secrets, e.g. a password or a key, so only
+		// the program run is shown.
+		args := strings.Fields(c.TokenCommand)
+		if len(args) <= 1 {
+			return strings.Join(args, "")
+		}
+		return fmt.Sprintf("%s <%d arguments redacted>", args[0], len(args)-1)
+	case "ProxyURL":
+		if u, err := url.Parse(c.ProxyURL); err == nil {
+			return u.Redacted()
+		}
+		return "<redacted: unparseable proxy URL>"
+	}
+	return value
+}
+
+// PrintConfig writes the effective config, once every source has been
+// merged and validated, in the given output format, for -print-config.
+func PrintConfig(w io.Writer, format string, c *Config) error {
+	settings := c.effectiveConfig()
+	if format == OutputJSON {
+		values := make(map[string]interface{})
+		for _, s := range settings {
+			values[s.key] = s.value
+		}
+		return (&jsonReporter{w: w}).encode(values)
+	}
+
+	for _, s := range settings {
+		value := fmt.Sprint(s.value)
+		if list, ok := s.value.([]string); ok {
+			value = strings.Join(list, ", ")
+		}
+		if _, err := fmt.Fprintf(w, "%s: %s\n", s.key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
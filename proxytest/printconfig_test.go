@@ -0,0 +1,21 @@
+package proxytest
+
+import "testing"
+
+func TestRedactSettingTokenCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"", ""},
+		{"print-token", "print-token"},
+		{"gcloud auth print-access-token", "gcloud <2 arguments redacted>"},
+		{"vault read -field=token secret/gcp --password=hunter2", "vault <4 arguments redacted>"},
+	}
+	for _, tt := range tests {
+		c := Config{TokenCommand: tt.command}
+		if got := c.redactSetting("TokenCommand", tt.command); got != tt.want {
+			t.Errorf("redactSetting(TokenCommand) with %q = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package proxytest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// validateProbeURL returns an error if rawURL isn't an HTTPS URL of a host
+// in the universe domain, unless anyHost is set. The request carries the
+// access token, which mustn't be sent just anywhere.
+func (c *Config) validateProbeURL(rawURL string, anyHost bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%q must be an absolute HTTP(S) URL", rawURL)
+	}
+	if anyHost {
+		return nil
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("%q must use HTTPS, or set -probe-any-host to send the access token over plain HTTP", rawURL)
+	}
+	host := u.Hostname()
+	if host != c.UniverseDomain && !strings.HasSuffix(host, "."+c.UniverseDomain) {
+		return fmt.Errorf("%s isn't a %s host; set -probe-any-host to send the access token to it anyway", host, c.UniverseDomain)
+	}
+	return nil
+}
+
+// checkProbeURL sends an authenticated GET to c.ProbeURL, for APIs without
+// a check of their own, e.g. a specific BigQuery or Pub/Sub method. It goes
+// through the same client, credentials, and proxy as every other check, and
+// summarizes the response's status, size, and top-level JSON fields.
+func checkProbeURL(ctx context.Context, c *Config) (string, error) {
+	if c.ProbeURL == "" {
+		return "", skip("no URL configured; set -probe-url")
+	}
+	target := c.ProbeURL
+	if c.Emulator != "" {
+		u, err := url.Parse(c.ProbeURL)
+		if err != nil {
+			return "", err
+		}
+		target = c.endpoint(c.ProbeURL)
+		if u.RawQuery != "" {
+			target += "?" + u.RawQuery
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error probing %s: %w", req.URL.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", fmt.Errorf("Error probing %s: %w", req.URL.Redacted(), err)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Error reading the response from %s: %w", req.URL.Redacted(), err)
+	}
+	detail := fmt.Sprintf("%s, %d bytes", resp.Status, len(body))
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) == nil && len(fields) > 0 {
+		var keys []string
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		detail += ", fields " + strings.Join(keys, ", ")
+	}
+	return detail, nil
+}
@@ -0,0 +1,75 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// defaultRefreshWait is how long -verify-refresh waits by default.
+const defaultRefreshWait = 2 * time.Second
+
+// refreshCheck mints a token, then a second one as if the first had
+// expired, for -verify-refresh.
+var refreshCheck = check{name: "refresh", label: "token refresh", run: checkRefresh}
+
+// VerifyRefresh runs only refreshCheck, reporting it like any other check.
+func (c *Config) VerifyRefresh(ctx context.Context, out Reporter) Report {
+	results := c.probe(ctx, out, refreshCheck)
+	report := Report{Success: true, Results: results, Retries: summarizeRetries(results)}
+	for _, result := range results {
+		if !result.Success && !result.Skipped {
+			report.Success = false
+		}
+	}
+	return report
+}
+
+// checkRefresh mints a token from a new token source, waits c.RefreshWait,
+// then treats the token as expired and mints another from a second new
+// source, the way a long run would refresh it. Token sources cache their
+// tokens, so new ones are needed to force each mint. A proxy that blocks the
+// token endpoint after the first request, e.g. because it only allows it
+// through once per connection, fails here but not in a single-shot run.
+func checkRefresh(ctx context.Context, c *Config) (string, error) {
+	if c.AccessToken != "" {
+		return "", skip("a static access token can't be refreshed")
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.tokenClient)
+
+	first, _, err := c.mintToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Error minting the first token: %w", err)
+	}
+
+	log.Printf("[INFO] Waiting %s before treating the first token as expired", c.RefreshWait)
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case <-time.After(c.RefreshWait):
+	}
+
+	second, elapsed, err := c.mintToken(ctx)
+	if err != nil {
+		return "", fmt.Errorf("Error refreshing the token: %w", err)
+	}
+	if second.AccessToken == first.AccessToken {
+		return fmt.Sprintf("refreshed in %s, but the same token was returned", elapsed.Round(time.Millisecond)), nil
+	}
+	return fmt.Sprintf("refreshed in %s", elapsed.Round(time.Millisecond)), nil
+}
+
+// mintToken mints a token from a new token source, returning how long it
+// took.
+func (c *Config) mintToken(ctx context.Context) (*oauth2.Token, time.Duration, error) {
+	source, err := c.getTokenSource(ctx, c.Scopes)
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	token, err := source.Token()
+	return token, time.Since(start), err
+}
@@ -0,0 +1,73 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultRegionalEndpoints are the regional endpoints probed when a region
+// is set but no templates are.
+var defaultRegionalEndpoints = []string{
+	"{region}-cloudfunctions.googleapis.com",
+	"{region}-run.googleapis.com",
+	"{region}-aiplatform.googleapis.com",
+}
+
+// regionalHosts returns the hosts of c.RegionalEndpoints, with {region}
+// replaced by c.Region.
+func (c *Config) regionalHosts() []string {
+	templates := c.RegionalEndpoints
+	if len(templates) == 0 {
+		templates = defaultRegionalEndpoints
+	}
+	var hosts []string
+	for _, template := range templates {
+		host := strings.TrimPrefix(template, "https://")
+		host = strings.TrimSuffix(host, "/")
+		hosts = append(hosts, c.inUniverse(strings.ReplaceAll(host, "{region}", c.Region)))
+	}
+	return hosts
+}
+
+// checkRegional sends an unauthenticated request to every regional
+// endpoint, through the same transport as API requests, reporting whether
+// each is reachable. Regional endpoints are often missing from proxy and
+// firewall allowlists that cover the global ones. Any HTTP response at all
+// means the endpoint is reachable.
+func checkRegional(ctx context.Context, c *Config) (string, error) {
+	if c.Region == "" {
+		return "", skip("no region configured; set GOOGLE_REGION")
+	}
+	// Regional endpoints aren't redirected to the emulator, so probing
+	// them would only say whether Google is reachable.
+	if c.Emulator != "" {
+		return "", skip("regional endpoints aren't emulated")
+	}
+	client := &http.Client{Transport: c.tokenClient.Transport}
+
+	var details, unreachable []string
+	var lastErr error
+	for _, host := range c.regionalHosts() {
+		req, err := http.NewRequestWithContext(withoutResponseGuard(ctx), "GET", "https://"+host+"/", nil)
+		if err != nil {
+			return "", fmt.Errorf("Invalid regional endpoint %q: %s", host, err)
+		}
+		req.Header.Set("User-Agent", c.userAgent)
+		resp, err := client.Do(req)
+		if err != nil {
+			unreachable = append(unreachable, host)
+			lastErr = fmt.Errorf("%s: %w", host, err)
+			continue
+		}
+		resp.Body.Close()
+		details = append(details, fmt.Sprintf("%s: reachable (%s)", host, resp.Status))
+	}
+	if len(unreachable) > 0 {
+		// The last error is wrapped so the failure is classified; the
+		// others usually fail the same way.
+		return "", fmt.Errorf("Unreachable regional endpoints %s, e.g. %w", strings.Join(unreachable, ", "), lastErr)
+	}
+	return strings.Join(details, "; "), nil
+}
@@ -0,0 +1,96 @@
+package proxytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Check is a probe that can be run alongside the built-in ones, e.g. of an
+// API the tool doesn't cover. Run makes a single call, reporting its outcome
+// in a Result; Check, Success, and Error, or Skipped and SkipReason, are the
+// fields that matter. Each Run is one attempt: it's repeated, retried, and
+// timed like any other check, so it shouldn't retry itself.
+type Check interface {
+	Name() string
+	Run(ctx context.Context, c *Config) Result
+}
+
+// Register adds chk to the checks, after those already registered, so it
+// can be selected with --checks and is run by RunChecks. It's meant to be
+// called from an init function, e.g.
+//
+//	func init() {
+//		proxytest.Register(pubsubCheck{})
+//	}
+//
+// Register panics if a check with the same name is already registered.
+func Register(chk Check) {
+	name := chk.Name()
+	if _, ok := lookupCheck(name); ok {
+		panic(fmt.Sprintf("proxytest: Register called twice for check %q", name))
+	}
+	checks = append(checks, check{
+		name:        name,
+		label:       name,
+		description: "registered with proxytest.Register",
+		run: func(ctx context.Context, c *Config) (string, error) {
+			result := chk.Run(ctx, c)
+			switch {
+			case result.Skipped:
+				return "", skip("%s", result.SkipReason)
+			case !result.Success:
+				return result.Detail, &resultError{result: result}
+			}
+			return result.Detail, nil
+		},
+	})
+}
+
+// Checks returns every registered check, built-in or added with Register,
+// in the order they run.
+func Checks() []Check {
+	list := make([]Check, 0, len(checks))
+	for _, chk := range checks {
+		list = append(list, chk)
+	}
+	return list
+}
+
+// Name returns the name that selects chk with --checks.
+func (chk check) Name() string {
+	return chk.name
+}
+
+// Run makes a single call of chk, bounded by its timeout but not retried.
+func (chk check) Run(ctx context.Context, c *Config) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.checkTimeout(chk.name))
+	defer cancel()
+	start := time.Now()
+	detail, err := chk.run(ctx, c)
+	return c.result(chk.name, 1, detail, err, time.Since(start))
+}
+
+// resultError is the error of a failed Result returned by a registered
+// Check, keeping the category it was given, if any.
+type resultError struct {
+	result Result
+}
+
+func (e *resultError) Error() string {
+	if e.result.Error == "" {
+		return "check failed"
+	}
+	return e.result.Error
+}
+
+// resultCategory returns the category of the failed Result err came from,
+// or "" if it has none.
+func resultCategory(err error) string {
+	var rerr *resultError
+	if errors.As(err, &rerr) {
+		return rerr.result.Category
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package proxytest
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// topicCheck is a registered check that always fails with a category of
+// its own, counting its calls.
+type topicCheck struct {
+	calls *atomic.Int64
+}
+
+func (topicCheck) Name() string { return "pubsub-topic" }
+
+func (chk topicCheck) Run(ctx context.Context, c *Config) Result {
+	chk.calls.Add(1)
+	return Result{Check: chk.Name(), Error: "topic projects/my-project/topics/events not found", Category: "pubsub"}
+}
+
+var topicCalls atomic.Int64
+
+func init() {
+	Register(topicCheck{calls: &topicCalls})
+}
+
+func TestRegister(t *testing.T) {
+	checks := Checks()
+	if last := checks[len(checks)-1]; last.Name() != "pubsub-topic" {
+		t.Fatalf("the last of Checks is %q, want the registered pubsub-topic", last.Name())
+	}
+
+	conf := newTestConfig(t, http.NotFoundHandler(), func(c *Config) {
+		c.Attempts = 3
+		c.Checks = []string{"pubsub-topic"}
+	})
+	topicCalls.Store(0)
+
+	report := conf.RunChecks(context.Background(), nil)
+	var results []Result
+	for _, r := range report.Results {
+		if r.Check == "pubsub-topic" {
+			results = append(results, r)
+		} else if !r.Skipped || r.SkipReason != notSelected {
+			t.Errorf("unselected %s check = %+v, want it skipped as %q", r.Check, r, notSelected)
+		}
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results of pubsub-topic, want 1, as attempts stop at the first failure", len(results))
+	}
+	if r := results[0]; r.Success || r.Category != "pubsub" || r.Error != "topic projects/my-project/topics/events not found" {
+		t.Errorf("pubsub-topic result = %+v, want its own failure and category", r)
+	}
+	if n := topicCalls.Load(); n != 1 {
+		t.Errorf("Run was called %d times, want once", n)
+	}
+	if report.Success {
+		t.Error("Success = true, want false when a registered check fails")
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("registering pubsub-topic twice didn't panic")
+		}
+	}()
+	Register(topicCheck{calls: &topicCalls})
+}
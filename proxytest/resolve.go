@@ -0,0 +1,99 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkResolve resolves the host of every endpoint the checks and token
+// requests use, reporting each host's addresses and how long resolving took.
+// DNS failures in locked down networks otherwise show up as confusing
+// errors from whichever request happens to come first. Hosts reached
+// through a proxy are resolved by the proxy, so they're not resolved here.
+func checkResolve(ctx context.Context, c *Config) (string, error) {
+	var resolved []string
+	for _, r := range c.resolveHosts(ctx) {
+		switch {
+		case r.Proxied:
+			resolved = append(resolved, r.Host+" (via proxy)")
+		case r.Error != "":
+			return "", fmt.Errorf("Error resolving %s: %s", r.Host, r.Error)
+		default:
+			resolved = append(resolved, fmt.Sprintf("%s -> %s in %s", r.Host, strings.Join(r.Addrs, ", "), time.Duration(r.DurationMs)*time.Millisecond))
+		}
+	}
+	return strings.Join(resolved, "; "), nil
+}
+
+// resolution is the outcome of resolving an endpoint host.
+type resolution struct {
+	Host       string   `json:"host"`
+	Proxied    bool     `json:"proxied,omitempty"`
+	Addrs      []string `json:"addrs,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	DurationMs int64    `json:"durationMs"`
+}
+
+// resolveHosts resolves every endpoint host that isn't reached through a
+// proxy.
+func (c *Config) resolveHosts(ctx context.Context) []resolution {
+	var resolver net.Resolver
+	var resolutions []resolution
+	for _, host := range c.endpointHosts() {
+		r := resolution{Host: host}
+		if c.proxied(host) {
+			r.Proxied = true
+		} else {
+			start := time.Now()
+			addrs, err := resolver.LookupHost(ctx, host)
+			r.DurationMs = time.Since(start).Milliseconds()
+			r.Addrs = addrs
+			if err != nil {
+				r.Error = err.Error()
+			}
+		}
+		resolutions = append(resolutions, r)
+	}
+	return resolutions
+}
+
+// endpointHosts returns the hosts of the configured API endpoints, and of
+// the token endpoints, without duplicates.
+func (c *Config) endpointHosts() []string {
+	endpoints := []string{
+		c.endpoint(tokenInfoURL),
+		c.endpoint(tokenURL),
+		c.clientBilling.BasePath,
+		c.clientResourceManager.BasePath,
+		c.clientResourceManagerV2.BasePath,
+		c.clientCompute.BasePath,
+		c.clientStorage.BasePath,
+		c.clientDNS.BasePath,
+	}
+	if c.clientServiceUsage != nil {
+		endpoints = append(endpoints, c.clientServiceUsage.BasePath)
+	}
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Hostname() == "" || seen[u.Hostname()] {
+			continue
+		}
+		seen[u.Hostname()] = true
+		hosts = append(hosts, u.Hostname())
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// proxied reports whether HTTPS requests to host go through a proxy.
+func (c *Config) proxied(host string) bool {
+	proxy, err := c.proxyFor(host)
+	return err == nil && proxy != nil
+}
@@ -0,0 +1,178 @@
+package proxytest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	resourceManagerV2 "google.golang.org/api/cloudresourcemanager/v2"
+)
+
+// checkOrg searches for the organizations visible to the credentials. With
+// c.OrgFilter, only matching organizations are counted, and it's an error
+// if none are visible. With c.FullList, it pages through them all and
+// reports how many there are. Otherwise, if c.OrgID is set, it reads that
+// organization instead.
+func checkOrg(ctx context.Context, c *Config) (string, error) {
+	if c.OrgID != "" && !c.FullList {
+		org, err := c.clientResourceManager.Organizations.Get(c.OrgID).Context(ctx).Do()
+		if err != nil {
+			return "", fmt.Errorf("Error reading organization %q: %w", c.OrgID, err)
+		}
+		return fmt.Sprintf("%s is %s", org.DisplayName, org.LifecycleState), nil
+	}
+
+	req := &cloudresourcemanager.SearchOrganizationsRequest{Filter: c.OrgFilter}
+	kind := "organizations"
+	if c.OrgFilter != "" {
+		kind = fmt.Sprintf("organizations matching %q", c.OrgFilter)
+	}
+
+	var n, pages int
+	var limited bool
+	if c.FullList {
+		err := c.clientResourceManager.Organizations.Search(req).Pages(ctx, func(resp *cloudresourcemanager.SearchOrganizationsResponse) error {
+			n += len(resp.Organizations)
+			pages++
+			if pages >= c.MaxPages && resp.NextPageToken != "" {
+				return errPageLimit
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errPageLimit) {
+			return "", fmt.Errorf("Error listing organizations: %w", err)
+		}
+		limited = err != nil
+	} else {
+		resp, err := c.clientResourceManager.Organizations.Search(req).Context(ctx).Do()
+		if err != nil {
+			return "", fmt.Errorf("Error listing organizations: %w", err)
+		}
+		n = len(resp.Organizations)
+	}
+
+	if c.OrgFilter != "" && n == 0 {
+		return "", fmt.Errorf("No organizations matching %q are visible to the credentials", c.OrgFilter)
+	}
+	if c.FullList {
+		return c.pageCount(n, pages, kind, limited), nil
+	}
+	if c.OrgFilter != "" {
+		return fmt.Sprintf("%d %s on the first page", n, kind), nil
+	}
+	return "", nil
+}
+
+// checkFolders lists the folders directly under the configured parent,
+// reporting how many there are. Folder access is granted separately from
+// organization access, so this can fail even when checkOrg succeeds.
+func checkFolders(ctx context.Context, c *Config) (string, error) {
+	if c.FolderParent == "" {
+		return "", skip("no folder parent configured; set GOOGLE_FOLDER_PARENT")
+	}
+	parent := c.FolderParent
+
+	if !c.FullList {
+		resp, err := c.clientResourceManagerV2.Folders.List().Parent(parent).Context(ctx).Do()
+		if err != nil {
+			return "", folderError(parent, err)
+		}
+		return fmt.Sprintf("%d folders on the first page", len(resp.Folders)), nil
+	}
+
+	var n, pages int
+	err := c.clientResourceManagerV2.Folders.List().Parent(parent).Pages(ctx, func(resp *resourceManagerV2.ListFoldersResponse) error {
+		n += len(resp.Folders)
+		pages++
+		if pages >= c.MaxPages && resp.NextPageToken != "" {
+			return errPageLimit
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageLimit) {
+		return "", folderError(parent, err)
+	}
+	return c.pageCount(n, pages, "folders", err != nil), nil
+}
+
+// folderError describes a failure to list the folders under parent, calling
+// out permission errors, which are the most common.
+func folderError(parent string, err error) error {
+	if httpStatus(err) == 403 {
+		return fmt.Errorf("Permission denied listing folders under %s; folder access is granted separately from organization access (resourcemanager.folders.list): %w", parent, err)
+	}
+	return fmt.Errorf("Error listing folders under %s: %w", parent, err)
+}
+
+// checkProjects lists the projects visible to the credentials. Unlike
+// searching organizations, this needs no org-level access.
+func checkProjects(ctx context.Context, c *Config) (string, error) {
+	resp, err := c.clientResourceManager.Projects.List().Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Error listing projects: %w", err)
+	}
+	return fmt.Sprintf("%d projects on the first page", len(resp.Projects)), nil
+}
+
+// checkProject reads the configured project, confirming it exists and is
+// visible to the credentials, and reports its lifecycle state and parent.
+func checkProject(ctx context.Context, c *Config) (string, error) {
+	if c.Project == "" {
+		return "", skip("no project configured; set GOOGLE_PROJECT")
+	}
+	project, err := c.clientResourceManager.Projects.Get(c.Project).Context(ctx).Do()
+	if err != nil {
+		if status := httpStatus(err); status == 403 || status == 404 {
+			return "", fmt.Errorf("Project %q doesn't exist or isn't visible to the credentials: %w", c.Project, err)
+		}
+		return "", fmt.Errorf("Error reading project %q: %w", c.Project, err)
+	}
+	parent := "none"
+	if project.Parent != nil {
+		parent = project.Parent.Type + "s/" + project.Parent.Id
+	}
+	return fmt.Sprintf("project %q is %s, parent %s", project.ProjectId, project.LifecycleState, parent), nil
+}
+
+// defaultPermissions are tested when no permissions are configured; they're
+// what's needed to bootstrap a project, a common first use of the provider.
+var defaultPermissions = []string{
+	"resourcemanager.projects.get",
+	"billing.resourceAssociations.create",
+}
+
+// checkPermissions asks which of the configured permissions the credentials
+// hold on the configured project, failing if any are missing.
+func checkPermissions(ctx context.Context, c *Config) (string, error) {
+	if c.Project == "" {
+		return "", skip("no project configured; set GOOGLE_PROJECT")
+	}
+	permissions := c.Permissions
+	if len(permissions) == 0 {
+		permissions = defaultPermissions
+	}
+
+	resp, err := c.clientResourceManager.Projects.TestIamPermissions(c.Project, &cloudresourcemanager.TestIamPermissionsRequest{
+		Permissions: permissions,
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Error testing IAM permissions on project %q: %w", c.Project, err)
+	}
+
+	granted := make(map[string]bool, len(resp.Permissions))
+	for _, p := range resp.Permissions {
+		granted[p] = true
+	}
+	var missing []string
+	for _, p := range permissions {
+		if !granted[p] {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Missing permissions on project %q: %s (granted: %s)", c.Project, strings.Join(missing, ", "), strings.Join(resp.Permissions, ", "))
+	}
+	return fmt.Sprintf("all permissions granted: %s", strings.Join(permissions, ", ")), nil
+}
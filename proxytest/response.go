@@ -0,0 +1,148 @@
+package proxytest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	// defaultMaxResponseSize is far larger than any response the checks
+	// expect, even a full page of projects.
+	defaultMaxResponseSize = 1 << 20
+
+	// responsePreviewBytes is how much of an unexpected response is shown,
+	// usually enough to recognize a captive portal or proxy error page.
+	responsePreviewBytes = 512
+)
+
+// errProxyInterference is wrapped by the error for a response that can't
+// have come from Google.
+var errProxyInterference = errors.New("response did not originate from Google APIs — proxy interference suspected")
+
+// googleServers are the Server headers Google's frontends respond with,
+// besides the versioned GFE/ ones.
+var googleServers = map[string]bool{
+	"ESF":                        true,
+	"GSE":                        true,
+	"gws":                        true,
+	"sffe":                       true,
+	"Google Frontend":            true,
+	"scaffolding on HTTPServer2": true,
+}
+
+// isGoogleServer reports whether server, a Server header, is one of Google's
+// frontends'.
+func isGoogleServer(server string) bool {
+	return googleServers[server] || strings.HasPrefix(server, "GFE/")
+}
+
+// responseGuardTransport reads the whole body of every response, failing
+// the request if it's larger than max bytes, unless max is zero, or isn't
+// valid JSON. Every Google API and token endpoint responds with JSON, so
+// anything else is almost certainly a proxy error or captive portal page,
+// e.g. an HTML login form, that would otherwise surface as a confusing
+// decoding error. Unless the requests go to an emulator, such a response
+// is reported as proxy interference, along with whatever else about it
+// doesn't look like Google. The exceptions are Google's own error pages: a
+// 5xx or 429 from one of its frontends is passed through untouched, so it's
+// retried and reported like any other, as are the responses of requests
+// made withoutResponseGuard.
+type responseGuardTransport struct {
+	max       int64
+	emulator  bool
+	transport http.RoundTripper
+}
+
+func (t *responseGuardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || req.Method == "HEAD" || resp.StatusCode == http.StatusNoContent || req.Context().Value(unguardedKey{}) != nil {
+		return resp, err
+	}
+	if (resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests) && isGoogleServer(resp.Header.Get("Server")) {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(resp.Body)
+	if t.max > 0 {
+		body = io.LimitReader(body, t.max+1)
+	}
+	contents, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the response from %s: %w", req.URL.Host, err)
+	}
+	var problem string
+	switch {
+	case t.max > 0 && int64(len(contents)) > t.max:
+		problem = fmt.Sprintf("is larger than %d bytes", t.max)
+	case len(contents) > 0 && !json.Valid(contents):
+		problem = "isn't JSON"
+	}
+	if problem != "" {
+		if t.emulator {
+			return nil, fmt.Errorf("Response from %s (%s, Content-Type %q) %s; it starts %s",
+				req.URL.Host, resp.Status, resp.Header.Get("Content-Type"), problem, preview(contents))
+		}
+		evidence := append([]string{"the body " + problem}, foreignSigns(resp)...)
+		return nil, fmt.Errorf("%w: the response from %s (%s) looks like a proxy error or captive portal page: %s; it starts %s",
+			errProxyInterference, req.URL.Host, resp.Status, strings.Join(evidence, ", "), preview(contents))
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(contents))
+	return resp, nil
+}
+
+// unguardedKey is the context key marking requests that
+// responseGuardTransport passes through.
+type unguardedKey struct{}
+
+// withoutResponseGuard returns ctx marked so that responseGuardTransport
+// passes through the responses of requests made with it. Reachability probes
+// accept any response at all, e.g. the HTML 404 Google serves for unknown
+// paths, so they'd otherwise fail on the very responses that show the host
+// was reached.
+func withoutResponseGuard(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unguardedKey{}, true)
+}
+
+// foreignSigns returns what about resp, besides its body, suggests it came
+// from something other than Google: an HTML Content-Type, a certificate that
+// Google Trust Services didn't issue, or a Server header that isn't one of
+// Google's frontends. A TLS-intercepting proxy trusted with -ca-cert changes
+// the issuer of genuine responses too, so it's only evidence, not a verdict.
+func foreignSigns(resp *http.Response) []string {
+	var signs []string
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "text/html" {
+		signs = append(signs, "its Content-Type is text/html")
+	}
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		issuer := resp.TLS.PeerCertificates[0].Issuer
+		if !slices.ContainsFunc(issuer.Organization, func(org string) bool {
+			return strings.HasPrefix(org, "Google Trust Services")
+		}) {
+			signs = append(signs, fmt.Sprintf("its certificate was issued by %s rather than Google Trust Services", issuer))
+		}
+	}
+	switch server := resp.Header.Get("Server"); {
+	case server == "":
+		signs = append(signs, "it has no Server header")
+	case !isGoogleServer(server):
+		signs = append(signs, fmt.Sprintf("its Server header %q isn't a Google frontend's", server))
+	}
+	return signs
+}
+
+// preview quotes the first responsePreviewBytes of contents.
+func preview(contents []byte) string {
+	if len(contents) <= responsePreviewBytes {
+		return fmt.Sprintf("%q", contents)
+	}
+	return fmt.Sprintf("%q...", contents[:responsePreviewBytes])
+}
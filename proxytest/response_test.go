@@ -0,0 +1,202 @@
+package proxytest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const portalPage = "<html><body>Please log in to continue</body></html>"
+
+func newGuardedClient(max int64) *http.Client {
+	return &http.Client{Transport: &responseGuardTransport{max: max, transport: http.DefaultTransport}}
+}
+
+func TestResponseGuardTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"name": "projects/my-project"}`)
+		case "/large":
+			io.WriteString(w, `["`+strings.Repeat("x", 100)+`"]`)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, portalPage)
+		}
+	}))
+	defer srv.Close()
+	client := newGuardedClient(64)
+
+	resp, err := client.Get(srv.URL + "/json")
+	if err != nil {
+		t.Fatalf("GET /json: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `{"name": "projects/my-project"}` {
+		t.Errorf("GET /json returned %q, want the body untouched", body)
+	}
+
+	_, err = client.Get(srv.URL + "/portal")
+	if !errors.Is(err, errProxyInterference) {
+		t.Fatalf("GET /portal = %v, want proxy interference", err)
+	}
+	if !strings.Contains(err.Error(), "its Content-Type is text/html") || !strings.Contains(err.Error(), "Please log in") {
+		t.Errorf("GET /portal error %q doesn't describe the page", err)
+	}
+
+	if _, err = client.Get(srv.URL + "/large"); err == nil || !strings.Contains(err.Error(), "is larger than 64 bytes") {
+		t.Errorf("GET /large = %v, want a size error", err)
+	}
+}
+
+func TestResponseGuardTransportUnguarded(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, portalPage)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequestWithContext(withoutResponseGuard(context.Background()), "GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := newGuardedClient(0).Do(req)
+	if err != nil {
+		t.Fatalf("unguarded GET = %s, want the response passed through", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unguarded GET status = %d, want 404", resp.StatusCode)
+	}
+}
+
+// gfeUnavailable writes the 503 Google's frontends serve when a backend is
+// overloaded, which is HTML rather than JSON.
+func gfeUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	w.Header().Set("Server", "GFE/2.0")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, "<!DOCTYPE html><html lang=en><title>Error 503 (Service Unavailable)!!1</title><p><b>503.</b> <ins>That’s an error.</ins></html>")
+}
+
+func TestResponseGuardTransportPassesGoogleErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gfe" {
+			gfeUnavailable(w)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, portalPage)
+	}))
+	defer srv.Close()
+	client := newGuardedClient(0)
+
+	resp, err := client.Get(srv.URL + "/gfe")
+	if err != nil {
+		t.Fatalf("GET /gfe = %s, want Google's error page passed through", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("GET /gfe status = %d, want 503", resp.StatusCode)
+	}
+
+	if _, err := client.Get(srv.URL + "/proxy"); !errors.Is(err, errProxyInterference) {
+		t.Errorf("GET /proxy = %v, want a 503 from something other than Google rejected", err)
+	}
+}
+
+// gfeBadGateway is a 502 as Google's frontends serve it, captured from a
+// load balancer whose backend was down.
+const gfeBadGateway = "HTTP/1.1 502 Bad Gateway\r\n" +
+	"Content-Type: text/html; charset=UTF-8\r\n" +
+	"Referrer-Policy: no-referrer\r\n" +
+	"Date: Tue, 13 Oct 2026 09:12:45 GMT\r\n" +
+	"Server: GFE/2.0\r\n" +
+	"\r\n" +
+	"<html><head><meta http-equiv=\"content-type\" content=\"text/html;charset=utf-8\">\n" +
+	"<title>502 Server Error</title>\n" +
+	"</head>\n" +
+	"<body text=#000000 bgcolor=#ffffff>\n" +
+	"<h1>Error: Server Error</h1>\n" +
+	"<h2>The server encountered a temporary error and could not complete your request.<p>Please try again in 30 seconds.</h2>\n" +
+	"<h2></h2>\n" +
+	"</body></html>\n"
+
+func TestForeignSignsGFEErrorPage(t *testing.T) {
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(gfeBadGateway)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if signs := foreignSigns(resp); len(signs) != 1 || signs[0] != "its Content-Type is text/html" {
+		t.Errorf("foreignSigns = %q, want only the HTML Content-Type, not the GFE Server header", signs)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer srv.Close()
+	got, err := newGuardedClient(0).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET = %s, want GFE's 502 passed through", err)
+	}
+	got.Body.Close()
+	if got.StatusCode != http.StatusBadGateway {
+		t.Errorf("GET status = %d, want 502", got.StatusCode)
+	}
+}
+
+func TestGoogleErrorPageIsRetried(t *testing.T) {
+	var calls atomic.Int32
+	conf := newTestConfig(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			gfeUnavailable(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}), func(c *Config) {
+		c.Checks = []string{"billing"}
+		c.RetryBaseDelay = time.Millisecond
+	})
+
+	r := resultOf(t, conf.RunChecks(context.Background(), nil), "billing")
+	if !r.Success {
+		t.Fatalf("billing check = %+v, want it to succeed on a retry", r)
+	}
+	if r.Tries != 2 {
+		t.Errorf("billing check took %d tries, want 2", r.Tries)
+	}
+}
+
+func TestCheckTokenURLAcceptsHTML(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, portalPage)
+	}))
+	defer srv.Close()
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, newGuardedClient(0))
+	f := credentialsFile{Type: externalAccountKey, TokenURL: srv.URL + "/v1/token"}
+	if err := checkTokenURL(ctx, f); err != nil {
+		t.Errorf("checkTokenURL = %s, want any response to count as reachable", err)
+	}
+}
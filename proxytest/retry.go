@@ -0,0 +1,162 @@
+package proxytest
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBaseDelay   = time.Second
+
+	// maxRetryDelay caps the exponential backoff, so a high attempt count
+	// doesn't stall a run for minutes between requests.
+	maxRetryDelay = 30 * time.Second
+)
+
+// retryableStatusCodes are the HTTP status codes that indicate a transient
+// failure worth retrying, mirroring the provider's retry behavior. Anything
+// else, notably 401 and 403, won't succeed on a retry.
+var retryableStatusCodes = map[int]bool{
+	429: true,
+	500: true,
+	502: true,
+	503: true,
+}
+
+// isRetryable reports whether err is likely to succeed if retried: it's a
+// connection reset, or a response with a status code in c.RetryOn or, if
+// that's empty, retryableStatusCodes.
+func (c *Config) isRetryable(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		if len(c.RetryOn) > 0 {
+			return slices.Contains(c.RetryOn, gerr.Code)
+		}
+		return retryableStatusCodes[gerr.Code]
+	}
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryStatusCodes returns the status codes that are retried, in order.
+func (c *Config) retryStatusCodes() []int {
+	if len(c.RetryOn) > 0 {
+		codes := slices.Clone(c.RetryOn)
+		slices.Sort(codes)
+		return slices.Compact(codes)
+	}
+	var codes []int
+	for code := range retryableStatusCodes {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	return codes
+}
+
+// httpStatus returns the status code of the HTTP response that caused err,
+// or 0 if the request failed without a response.
+func httpStatus(err error) int {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code
+	}
+	return 0
+}
+
+// isNetworkError reports whether err means no HTTP response was received at
+// all, e.g. because a connection timed out or was refused or reset.
+func isNetworkError(err error) bool {
+	if httpStatus(err) != 0 {
+		return false
+	}
+	var uerr *url.Error
+	var nerr net.Error
+	return errors.As(err, &uerr) || errors.As(err, &nerr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// retry calls fn until it succeeds, returns an error that isn't retryable,
+// or has been called c.RetryMaxAttempts times, sleeping between calls for as
+// long as the response's Retry-After header asks, or otherwise with
+// exponential backoff and jitter. It returns the number of calls made, the
+// time spent sleeping between them, and the last error. With
+// c.FailFastOnHTTP, only network errors are retried and any HTTP response is
+// final.
+func (c *Config) retry(ctx context.Context, fn func() error) (int, time.Duration, error) {
+	retryable := c.isRetryable
+	if c.FailFastOnHTTP {
+		retryable = isNetworkError
+	}
+	var slept time.Duration
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.RetryMaxAttempts || !retryable(err) {
+			return attempt, slept, err
+		}
+
+		delay := backoff(c.RetryBaseDelay, attempt)
+		if after, ok := retryAfter(err, time.Now()); ok {
+			if after > maxRetryDelay {
+				after = maxRetryDelay
+			}
+			log.Printf("[INFO] Honoring Retry-After of %s from the response to attempt %d", after, attempt)
+			delay = after
+		}
+		log.Printf("[DEBUG] Retrying in %s after attempt %d failed: %s", delay, attempt, err)
+		start := time.Now()
+		select {
+		case <-ctx.Done():
+			return attempt, slept + time.Since(start), err
+		case <-time.After(delay):
+		}
+		slept += time.Since(start)
+	}
+}
+
+// retryAfter returns how long the Retry-After header of the response that
+// caused err asks clients to wait, relative to now. ok is false if there's
+// no response or no valid header.
+func retryAfter(err error, now time.Time) (d time.Duration, ok bool) {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return 0, false
+	}
+	header := gerr.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+	// The header is either a number of seconds or an HTTP date.
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	log.Printf("[WARN] Ignoring invalid Retry-After header %q", header)
+	return 0, false
+}
+
+// backoff returns how long to wait after the given attempt: base doubled for
+// each previous attempt, capped at maxRetryDelay, with the upper half of the
+// delay randomized so concurrent clients don't retry in lockstep.
+func backoff(base time.Duration, attempt int) time.Duration {
+	delay := base << uint(attempt-1)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,199 @@
+package proxytest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the Prometheus metrics exported in -serve mode, each labeled
+// by check name.
+type metrics struct {
+	success  *prometheus.GaugeVec
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		success: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gcp_proxy_probe_success",
+			Help: "Whether every attempt of the check succeeded in the last run (1) or not (0).",
+		}, []string{"check"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gcp_proxy_probe_duration_seconds",
+			Help:    "Duration of each attempt of the check, excluding time spent backing off between retries.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"check"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gcp_proxy_probe_errors_total",
+			Help: "Number of attempts of the check that failed.",
+		}, []string{"check"}),
+	}
+	reg.MustRegister(m.success, m.duration, m.errors)
+	return m
+}
+
+// metricsReporter is a Reporter that records results as metrics rather
+// than printing them.
+type metricsReporter struct {
+	metrics *metrics
+	// threshold is how many attempts of a check must succeed for it to
+	// count as up; zero means all of them.
+	threshold int
+}
+
+func (m *metricsReporter) ConfigLoaded()          {}
+func (m *metricsReporter) StartCheck(string)      {}
+func (m *metricsReporter) Finish(Report) error    { return nil }
+func (m *metricsReporter) Section(string)         {}
+func (m *metricsReporter) Compare([]Report) error { return nil }
+
+func (m *metricsReporter) Attempt(r Result) {
+	if r.Skipped {
+		return
+	}
+	m.metrics.duration.WithLabelValues(r.Check).Observe((time.Duration(r.DurationMs) * time.Millisecond).Seconds())
+	if !r.Success {
+		m.metrics.errors.WithLabelValues(r.Check).Inc()
+	}
+}
+
+func (m *metricsReporter) EndCheck(results []Result) {
+	// Checks that were skipped have no success metric, rather than one that
+	// would look like a failure.
+	var name string
+	var attempts, succeeded int
+	for _, r := range results {
+		if r.Skipped {
+			continue
+		}
+		name = r.Check
+		attempts++
+		if r.Success {
+			succeeded++
+		}
+	}
+	required := attempts
+	if m.threshold > 0 {
+		required = m.threshold
+	}
+	success := 0.0
+	if succeeded >= required {
+		success = 1
+	}
+	if name != "" {
+		m.metrics.success.WithLabelValues(name).Set(success)
+	}
+}
+
+// health tracks the outcome of the most recent run of the checks for the
+// /healthz endpoint.
+type health struct {
+	mu          sync.Mutex
+	ran         bool
+	failed      []string
+	lastRun     time.Time
+	lastSuccess time.Time
+}
+
+// update records report as the most recent run, completed at t.
+func (h *health) update(report Report, t time.Time) {
+	failed := failedChecks(report)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ran = true
+	h.failed = failed
+	h.lastRun = t
+	if report.Success {
+		h.lastSuccess = t
+	}
+}
+
+// ServeHTTP responds 200 if the most recent run fully succeeded, and 503 if
+// it failed or no run has completed yet, describing the run in JSON.
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	body := struct {
+		Success      bool       `json:"success"`
+		FailedChecks []string   `json:"failedChecks,omitempty"`
+		LastRun      *time.Time `json:"lastRun,omitempty"`
+		LastSuccess  *time.Time `json:"lastSuccess,omitempty"`
+	}{
+		Success:      h.ran && len(h.failed) == 0,
+		FailedChecks: h.failed,
+	}
+	if !h.lastRun.IsZero() {
+		lastRun := h.lastRun
+		body.LastRun = &lastRun
+	}
+	if !h.lastSuccess.IsZero() {
+		lastSuccess := h.lastSuccess
+		body.LastSuccess = &lastSuccess
+	}
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !body.Success {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// Serve runs the checks every interval until ctx is done, exposing their
+// results as Prometheus metrics on /metrics at addr, and whether the most
+// recent run succeeded on /healthz. If stream is set, results are also
+// reported to it as they come, e.g. to print them as JSON Lines.
+func (c *Config) Serve(ctx context.Context, addr string, interval time.Duration, stream Reporter) error {
+	if interval <= 0 {
+		return fmt.Errorf("Serve interval must be positive, got %s", interval)
+	}
+
+	reg := prometheus.NewRegistry()
+	var out Reporter = &metricsReporter{metrics: newMetrics(reg), threshold: c.FailThreshold}
+	if stream != nil {
+		out = teeReporter{out, stream}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	healthz := &health{}
+	mux.Handle("/healthz", healthz)
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+	log.Printf("[INFO] Serving metrics on %s/metrics, running checks every %s", addr, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for runs := 0; ; runs++ {
+		if c.ReloadCredentials && runs > 0 {
+			c.reloadCredentials()
+		}
+		report := c.RunChecks(ctx, out)
+		healthz.update(report, time.Now())
+		log.Printf("[INFO] Ran checks, success: %t", report.Success)
+		if err := out.Finish(report); err != nil {
+			return err
+		}
+
+		select {
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return srv.Shutdown(context.Background())
+		case <-ticker.C:
+		}
+	}
+}
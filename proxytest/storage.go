@@ -0,0 +1,19 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+)
+
+// checkStorage lists a bucket in the configured project, exercising the
+// devstorage scope that's requested by default.
+func checkStorage(ctx context.Context, c *Config) (string, error) {
+	if c.Project == "" {
+		return "", skip("no project configured; set GOOGLE_PROJECT")
+	}
+	_, err := c.clientStorage.Buckets.List(c.Project).MaxResults(1).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("Error listing storage buckets in project %q: %w", c.Project, err)
+	}
+	return "", nil
+}
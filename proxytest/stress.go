@@ -0,0 +1,152 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stressChecks are the checks whose calls -stress sends, in turn. They're
+// cheap, read-only, and need nothing but credentials.
+var stressChecks = []string{"billing", "org"}
+
+// maxStressRate is the most calls a second -stress sends, far more than is
+// needed to find a proxy's limits, and about as fast as a ticker can pace
+// them.
+const maxStressRate = 1000
+
+// StressReport is the outcome of a -stress run.
+type StressReport struct {
+	Requests    int     `json:"requests"`
+	Succeeded   int     `json:"succeeded"`
+	SuccessRate float64 `json:"successRate"`
+	// Dropped counts requests that weren't sent because Concurrency were
+	// already in flight, a sign the rate is higher than can be sustained.
+	Dropped int            `json:"dropped"`
+	P50Ms   int64          `json:"p50Ms"`
+	P95Ms   int64          `json:"p95Ms"`
+	P99Ms   int64          `json:"p99Ms"`
+	Errors  map[string]int `json:"errors"`
+}
+
+// Stress sends rate calls a second, alternating between stressChecks, for
+// duration or until ctx is done, with at most concurrency in flight. Calls
+// aren't retried, so every failure counts. The report is written to w in the
+// given format, and it returns whether every call succeeded.
+func (c *Config) Stress(ctx context.Context, w io.Writer, format string, duration time.Duration, rate, concurrency int) (bool, error) {
+	if duration <= 0 {
+		return false, fmt.Errorf("Stress duration must be positive, got %s", duration)
+	}
+	if rate < 1 || rate > maxStressRate {
+		return false, fmt.Errorf("Stress rate must be between 1 and %d, got %d", maxStressRate, rate)
+	}
+	if concurrency < 1 {
+		return false, fmt.Errorf("Stress concurrency must be at least 1, got %d", concurrency)
+	}
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	log.Printf("[INFO] Sending %d requests a second for %s, at most %d at once", rate, duration, concurrency)
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	report := StressReport{Errors: make(map[string]int)}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+loop:
+	for i := 0; ; i++ {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+		}
+		select {
+		case sem <- struct{}{}:
+		default:
+			mu.Lock()
+			report.Dropped++
+			mu.Unlock()
+			continue
+		}
+
+		chk, _ := lookupCheck(stressChecks[i%len(stressChecks)])
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			callCtx, cancel := context.WithTimeout(ctx, c.checkTimeout(chk.name))
+			defer cancel()
+			start := time.Now()
+			_, err := chk.run(callCtx, c)
+			elapsed := time.Since(start)
+			// Calls cut short by the end of the run aren't counted.
+			if ctx.Err() != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Requests++
+			if err != nil {
+				report.Errors[classifyError(err)]++
+				return
+			}
+			report.Succeeded++
+			latencies = append(latencies, elapsed)
+		}()
+	}
+	wg.Wait()
+
+	// With nothing completed there's no success rate or latency to report,
+	// and 0 of 0 requests succeeding isn't a pass.
+	if report.Requests == 0 {
+		if report.Dropped > 0 {
+			return false, fmt.Errorf("No requests completed within %s, and %d weren't sent with %d already in flight", duration, report.Dropped, concurrency)
+		}
+		return false, fmt.Errorf("No requests completed within %s", duration)
+	}
+	report.SuccessRate = float64(report.Succeeded) / float64(report.Requests)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.P50Ms = percentile(latencies, 50).Milliseconds()
+	report.P95Ms = percentile(latencies, 95).Milliseconds()
+	report.P99Ms = percentile(latencies, 99).Milliseconds()
+
+	if format == OutputJSON {
+		return report.Succeeded == report.Requests, (&jsonReporter{w: w}).encode(report)
+	}
+	fmt.Fprintf(w, "Requests: %d, %d succeeded (%.1f%%)", report.Requests, report.Succeeded, 100*report.SuccessRate)
+	if report.Dropped > 0 {
+		fmt.Fprintf(w, ", %d not sent with %d already in flight", report.Dropped, concurrency)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Latency of successful requests: p50 %dms, p95 %dms, p99 %dms\n", report.P50Ms, report.P95Ms, report.P99Ms)
+	if len(report.Errors) > 0 {
+		var categories []string
+		for category := range report.Errors {
+			categories = append(categories, category)
+		}
+		sort.Strings(categories)
+		fmt.Fprintln(w, "Errors:")
+		for _, category := range categories {
+			fmt.Fprintf(w, "  %s: %d\n", category, report.Errors[category])
+		}
+	}
+	return report.Succeeded == report.Requests, nil
+}
+
+// percentile returns the pth percentile of sorted, by the nearest rank
+// method, or zero if it's empty.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
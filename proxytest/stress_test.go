@@ -0,0 +1,33 @@
+package proxytest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStressRejectsInvalidRate(t *testing.T) {
+	var c Config
+	for _, rate := range []int{0, -1, maxStressRate + 1, 2e9} {
+		_, err := c.Stress(context.Background(), io.Discard, OutputText, time.Second, rate, 1)
+		if err == nil || !strings.Contains(err.Error(), "Stress rate must be between 1 and") {
+			t.Errorf("Stress with rate %d = %v, want a rate error", rate, err)
+		}
+	}
+}
+
+func TestStressFailsWithNoRequests(t *testing.T) {
+	conf := newTestConfig(t, http.NotFoundHandler(), nil)
+
+	// At one request a second, the first isn't due before the run ends.
+	success, err := conf.Stress(context.Background(), io.Discard, OutputText, 50*time.Millisecond, 1, 1)
+	if success {
+		t.Error("Stress succeeded, want a failure when no requests completed")
+	}
+	if err == nil || !strings.Contains(err.Error(), "No requests completed") {
+		t.Errorf("Stress = %v, want an error saying no requests completed", err)
+	}
+}
@@ -0,0 +1,209 @@
+package proxytest
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// checkTLS opens a TCP connection to port 443 of every endpoint host, or
+// the emulator's port, through the proxy if requests to it use one, and
+// completes a TLS handshake with the same trusted CAs as API requests. This
+// separates network and TLS problems from API and auth ones. The issuer of
+// each host's certificate is reported, so a proxy intercepting TLS is
+// obvious.
+func checkTLS(ctx context.Context, c *Config) (string, error) {
+	if c.plainEmulator() {
+		return "", skip("the emulator is served over plain HTTP")
+	}
+	var details []string
+	for _, host := range c.endpointHosts() {
+		state, err := c.handshake(ctx, host)
+		if err != nil {
+			return "", err
+		}
+		leaf := state.PeerCertificates[0]
+		protocol := state.NegotiatedProtocol
+		if protocol == "" {
+			protocol = "no ALPN"
+		}
+		details = append(details, fmt.Sprintf("%s: %s %s (%s), chain of %d issued by %s", host,
+			tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), protocol, len(state.PeerCertificates), leaf.Issuer))
+	}
+	return strings.Join(details, "; "), nil
+}
+
+// handshake connects to port 443 of host, or the emulator's port, and
+// completes a TLS handshake using the settings of c's transport. If the
+// certificate can't be verified, the error names its issuer.
+func (c *Config) handshake(ctx context.Context, host string) (*tls.ConnectionState, error) {
+	addr := c.hostAddr(host)
+	conn, err := c.dial(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	config := c.transport.TLSClientConfig.Clone()
+	config.ServerName = host
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		var verr *tls.CertificateVerificationError
+		if errors.As(err, &verr) && len(verr.UnverifiedCertificates) > 0 {
+			return nil, fmt.Errorf("Error verifying the certificate of %s, issued by %s; if that's your proxy, trust its CA with -ca-cert: %w", host, verr.UnverifiedCertificates[0].Issuer, err)
+		}
+		return nil, fmt.Errorf("Error completing a TLS handshake with %s: %w", addr, err)
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+// dial opens a TCP connection to addr, tunneling through the proxy that
+// HTTPS requests to it would use, if any.
+func (c *Config) dial(ctx context.Context, addr string) (net.Conn, error) {
+	proxyURL, err := c.proxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := c.dialer()
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	if proxyURL.Scheme == "socks5" {
+		socks, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+
+	conn, resp, err := c.connect(ctx, proxyURL, addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s refused to CONNECT to %s: %s", proxyURL.Redacted(), addr, resp.Status)
+	}
+	return conn, nil
+}
+
+// proxyFor returns the proxy HTTPS requests to addr use, or nil if they
+// connect directly.
+func (c *Config) proxyFor(addr string) (*url.URL, error) {
+	req, err := http.NewRequest("GET", "https://"+addr+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.transport.Proxy(req)
+}
+
+// connect opens a connection to the HTTP(S) proxy at proxyURL and asks it to
+// CONNECT to addr, authenticating with any credentials in the URL or the
+// configured proxy credentials. It returns the connection, which tunnels to
+// addr if the response is a 200, along with the proxy's response.
+func (c *Config) connect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, *http.Response, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	conn, err := c.dialer().DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error connecting to proxy %s: %w", proxyURL.Redacted(), err)
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname(), RootCAs: c.transport.TLSClientConfig.RootCAs})
+	}
+
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: c.transport.ProxyConnectHeader.Clone(),
+	}
+	if connect.Header == nil {
+		connect.Header = make(http.Header)
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		connect.SetBasicAuth(u.Username(), password)
+		connect.Header["Proxy-Authorization"] = connect.Header["Authorization"]
+		delete(connect.Header, "Authorization")
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Error sending CONNECT to proxy %s: %w", proxyURL.Redacted(), err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("Error reading CONNECT response from proxy %s: %w", proxyURL.Redacted(), err)
+	}
+	resp.Body.Close()
+	return conn, resp, nil
+}
+
+// checkConnect asks the proxy to CONNECT to every endpoint host, reporting
+// its response, without going on to a TLS handshake or API call. This
+// separates a proxy refusing the tunnel, e.g. with a 407 because it needs
+// credentials or a 403 because the host isn't allowed, from problems beyond
+// it.
+func checkConnect(ctx context.Context, c *Config) (string, error) {
+	var details []string
+	for _, host := range c.endpointHosts() {
+		addr := c.hostAddr(host)
+		proxyURL, err := c.proxyFor(addr)
+		if err != nil {
+			return "", err
+		}
+		if proxyURL == nil || proxyURL.Scheme == "socks5" {
+			continue
+		}
+
+		conn, resp, err := c.connect(ctx, proxyURL, addr)
+		if err != nil {
+			return "", err
+		}
+		conn.Close()
+
+		var headers string
+		for _, h := range []string{"Proxy-Agent", "Via", "Proxy-Authenticate"} {
+			if v := resp.Header.Get(h); v != "" {
+				headers += fmt.Sprintf(" [%s: %s]", h, v)
+			}
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusProxyAuthRequired:
+			if proxyURL.User == nil && c.ProxyUser == "" {
+				return "", fmt.Errorf("Proxy %s requires authentication to CONNECT to %s (%s%s), but no proxy credentials are configured; set GCP_PROXY_USER and GCP_PROXY_PASSWORD", proxyURL.Redacted(), addr, resp.Status, headers)
+			}
+			return "", fmt.Errorf("Proxy %s rejected the proxy credentials for CONNECT to %s: %s%s", proxyURL.Redacted(), addr, resp.Status, headers)
+		case http.StatusForbidden:
+			return "", fmt.Errorf("Proxy %s blocked CONNECT to %s, which likely needs adding to its allowlist: %s%s", proxyURL.Redacted(), addr, resp.Status, headers)
+		default:
+			return "", fmt.Errorf("Proxy %s refused to CONNECT to %s: %s%s", proxyURL.Redacted(), addr, resp.Status, headers)
+		}
+		details = append(details, fmt.Sprintf("%s: %s%s", host, resp.Status, headers))
+	}
+	if len(details) == 0 {
+		return "", skip("no HTTP(S) proxy is used for the API hosts")
+	}
+	return strings.Join(details, "; "), nil
+}
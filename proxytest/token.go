@@ -0,0 +1,40 @@
+package proxytest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkToken sends a deliberately incomplete request to the token endpoint,
+// through the same transport as token requests but without credentials, so
+// its reachability and latency are measured apart from any API. Proxies are
+// often configured to allow the API hosts but not the token endpoint, which
+// makes every check fail in ways that don't point at the cause. An OAuth
+// error response, e.g. invalid_request, shows the endpoint was reached.
+func checkToken(ctx context.Context, c *Config) (string, error) {
+	endpoint := c.endpoint(tokenURL)
+	body := url.Values{"grant_type": {"refresh_token"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", c.userAgent)
+	resp, err := c.tokenClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Error reaching the token endpoint %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	var oauthErr struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&oauthErr); err != nil || oauthErr.Error == "" {
+		return "", fmt.Errorf("Token endpoint %s responded %s without an OAuth error; something other than Google may have answered", endpoint, resp.Status)
+	}
+	return fmt.Sprintf("%s reachable, responded %s %s to an empty grant", req.URL.Host, resp.Status, oauthErr.Error), nil
+}
@@ -0,0 +1,71 @@
+package proxytest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenCommandLifetime is how long a token printed by a token command is
+// used before the command is run again. Commands only print the token, not
+// its expiry, so this is kept well short of the usual hour.
+const tokenCommandLifetime = 5 * time.Minute
+
+// commandTokenSource is a TokenSource that runs a command, such as
+// "gcloud auth print-access-token", and uses what it prints as the token.
+type commandTokenSource struct {
+	ctx     context.Context
+	args    []string
+	timeout time.Duration
+}
+
+// newCommandTokenSource returns a TokenSource for command, which is split
+// into arguments on whitespace and run without a shell. Each run of the
+// command is killed if it takes longer than timeout, or once ctx is done.
+// The command is only run again once its last token is due to expire.
+func newCommandTokenSource(ctx context.Context, command string, timeout time.Duration) (oauth2.TokenSource, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("Token command is empty")
+	}
+	return oauth2.ReuseTokenSource(nil, &commandTokenSource{ctx: ctx, args: args, timeout: timeout}), nil
+}
+
+func (s *commandTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.args[0], s.args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("Token command %q timed out after %s", s.args[0], s.timeout)
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			msg := fmt.Sprintf("Token command %q failed with exit code %d", s.args[0], exitErr.ExitCode())
+			if output := strings.TrimSpace(stderr.String()); output != "" {
+				msg += ": " + output
+			}
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("Error running token command %q: %s", s.args[0], err)
+	}
+
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return nil, fmt.Errorf("Token command %q printed no token", s.args[0])
+	}
+	return &oauth2.Token{
+		AccessToken: token,
+		Expiry:      time.Now().Add(tokenCommandLifetime),
+	}, nil
+}
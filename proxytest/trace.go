@@ -0,0 +1,174 @@
+package proxytest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connTrace records when each phase of a request happened, using
+// net/http/httptrace. Hooks can run on other goroutines, e.g. when dialing
+// several addresses at once, so fields are guarded by mu.
+type connTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	firstByte    time.Time
+	reused       bool
+}
+
+// traceRequest returns a copy of req that records its phases in the
+// returned connTrace.
+func traceRequest(req *http.Request) (*http.Request, *connTrace) {
+	t := &connTrace{start: time.Now()}
+	mark := func(field *time.Time) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		// With several addresses, only the first attempt's start counts.
+		if field.IsZero() {
+			*field = time.Now()
+		}
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { mark(&t.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { mark(&t.dnsDone) },
+		ConnectStart:         func(string, string) { mark(&t.connectStart) },
+		ConnectDone:          func(string, string, error) { mark(&t.connectDone) },
+		TLSHandshakeStart:    func() { mark(&t.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { mark(&t.tlsDone) },
+		GotFirstResponseByte: func() { mark(&t.firstByte) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			mark(&t.gotConn)
+			t.mu.Lock()
+			t.reused = info.Reused
+			t.mu.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// phase is the duration of one phase of a request.
+type phase struct {
+	name     string
+	duration time.Duration
+}
+
+// phases returns the duration of each phase that happened. When going
+// through a proxy, connect is the connection to the proxy and tls includes
+// the CONNECT tunnel being established.
+func (t *connTrace) phases() []phase {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var phases []phase
+	add := func(name string, start, end time.Time) {
+		if !start.IsZero() && !end.IsZero() {
+			phases = append(phases, phase{name, end.Sub(start)})
+		}
+	}
+	add("dns", t.dnsStart, t.dnsDone)
+	add("connect", t.connectStart, t.connectDone)
+	add("tls", t.tlsStart, t.tlsDone)
+	add("ttfb", t.gotConn, t.firstByte)
+	return phases
+}
+
+// String summarizes the phases, noting which one took the longest.
+func (t *connTrace) String() string {
+	phases := t.phases()
+	var parts []string
+	var slowest phase
+	for _, p := range phases {
+		parts = append(parts, fmt.Sprintf("%s=%s", p.name, p.duration.Round(time.Millisecond)))
+		if p.duration > slowest.duration {
+			slowest = p
+		}
+	}
+	t.mu.Lock()
+	reused := t.reused
+	t.mu.Unlock()
+	if reused {
+		parts = append(parts, "connection reused")
+	}
+	if len(parts) == 0 {
+		return "no connection phases recorded"
+	}
+	s := strings.Join(parts, " ")
+	if slowest.name != "" {
+		s += fmt.Sprintf(" (dominated by %s)", slowest.name)
+	}
+	return s
+}
+
+// ConnectionReuse counts the requests made to a host, and how many of them
+// reused a pooled connection rather than opening a new one.
+type ConnectionReuse struct {
+	Host     string `json:"host"`
+	Requests int    `json:"requests"`
+	Reused   int    `json:"reused"`
+}
+
+// connStats counts connection reuse per host across a run.
+type connStats struct {
+	mu     sync.Mutex
+	counts map[string]*ConnectionReuse
+}
+
+// record counts a request to host, which got a reused connection if reused.
+func (s *connStats) record(host string, reused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = make(map[string]*ConnectionReuse)
+	}
+	r, ok := s.counts[host]
+	if !ok {
+		r = &ConnectionReuse{Host: host}
+		s.counts[host] = r
+	}
+	r.Requests++
+	if reused {
+		r.Reused++
+	}
+}
+
+// take returns the counts per host, sorted by host, and resets them for the
+// next run.
+func (s *connStats) take() []ConnectionReuse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var counts []ConnectionReuse
+	for _, r := range s.counts {
+		counts = append(counts, *r)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Host < counts[j].Host })
+	s.counts = nil
+	return counts
+}
+
+// reuseTransport records in stats whether each request reused a pooled
+// connection. A proxy that closes connections after every request makes
+// each one pay for a new TCP and TLS handshake, which shows up as a low
+// reuse ratio.
+type reuseTransport struct {
+	stats     *connStats
+	transport http.RoundTripper
+}
+
+func (t *reuseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { t.stats.record(host, info.Reused) },
+	}
+	return t.transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
@@ -0,0 +1,325 @@
+package proxytest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newTransport builds the base transport that every request, including
+// token fetches, is sent through.
+func (c *Config) newTransport() (*http.Transport, error) {
+	proxy, err := c.proxyFunc()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ProxyPassword != "" && c.ProxyUser == "" {
+		return nil, fmt.Errorf("GCP_PROXY_PASSWORD is set, but GCP_PROXY_USER is not; set the user to authenticate to the proxy as")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.DialContext = c.dialer().DialContext
+	transport.MaxIdleConns = c.MaxIdleConns
+	transport.IdleConnTimeout = c.IdleConnTimeout
+	transport.DisableKeepAlives = c.DisableKeepAlives
+	log.Printf("[DEBUG] Transport: MaxIdleConns=%d (0 is unlimited), IdleConnTimeout=%s (0 is none), DisableKeepAlives=%t",
+		transport.MaxIdleConns, transport.IdleConnTimeout, transport.DisableKeepAlives)
+	if c.ProxyUser != "" {
+		// HTTPS requests go through the proxy with CONNECT, so that's the
+		// only request the proxy sees and needs to authenticate.
+		log.Printf("[INFO] Authenticating to the proxy as %q", c.ProxyUser)
+		transport.ProxyConnectHeader = http.Header{
+			"Proxy-Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(c.ProxyUser+":"+c.ProxyPassword))},
+		}
+	}
+	transport.TLSClientConfig = &tls.Config{}
+	switch c.HTTPVersion {
+	case httpVersion1:
+		// A non-nil, empty TLSNextProto disables HTTP/2.
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	case httpVersion2:
+		transport.ForceAttemptHTTP2 = true
+		transport.TLSClientConfig.NextProtos = []string{"h2"}
+	}
+
+	if c.CABundle != "" {
+		roots, err := loadCABundle(c.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[INFO] Trusting certificates in CA bundle %s", c.CABundle)
+		transport.TLSClientConfig.RootCAs = roots
+	}
+	if c.Insecure {
+		if os.Getenv("GCP_ALLOW_INSECURE") != "1" {
+			return nil, fmt.Errorf("Refusing to skip TLS verification: -insecure also requires GCP_ALLOW_INSECURE=1 in the environment")
+		}
+		warnInsecure(os.Stderr)
+		transport.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return transport, nil
+}
+
+// Connection pool defaults, the same as http.DefaultTransport's, as is the
+// connect timeout.
+const (
+	defaultConnectTimeout  = 30 * time.Second
+	defaultMaxIdleConns    = 100
+	defaultIdleConnTimeout = 90 * time.Second
+)
+
+// HTTP versions that requests can be restricted to.
+const (
+	httpVersionAuto = "auto"
+	httpVersion1    = "1.1"
+	httpVersion2    = "2"
+)
+
+// IP versions that connections can be restricted to.
+const (
+	ipVersionAuto = "auto"
+	ipVersion4    = "4"
+	ipVersion6    = "6"
+)
+
+// familyDialer dials TCP connections over the address family selected by
+// IPVersion, logging which family each connection actually used.
+type familyDialer struct {
+	net.Dialer
+	ipVersion string
+}
+
+// dialer returns the dialer used for every connection, to Google or a
+// proxy, which gives up on connecting after c.ConnectTimeout.
+func (c *Config) dialer() *familyDialer {
+	return &familyDialer{
+		Dialer:    net.Dialer{Timeout: c.ConnectTimeout, KeepAlive: 30 * time.Second},
+		ipVersion: c.IPVersion,
+	}
+}
+
+func (d *familyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *familyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "tcp" {
+		switch d.ipVersion {
+		case ipVersion4:
+			network = "tcp4"
+		case ipVersion6:
+			network = "tcp6"
+		}
+	}
+	start := time.Now()
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return nil, &connectTimeoutError{addr: addr, elapsed: time.Since(start), connectTimeout: ctx.Err() == nil, err: err}
+		}
+		return nil, err
+	}
+	family := "IPv6"
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok && tcp.IP.To4() != nil {
+		family = "IPv4"
+	}
+	log.Printf("[INFO] Connected to %s (%s) over %s", addr, conn.RemoteAddr(), family)
+	return conn, nil
+}
+
+// connectTimeoutError is returned when a TCP connection can't be
+// established in time, as happens when a proxy or firewall silently drops
+// packets. connectTimeout is set if the connect timeout ran out, rather than
+// the timeout of the request as a whole.
+type connectTimeoutError struct {
+	addr           string
+	elapsed        time.Duration
+	connectTimeout bool
+	err            error
+}
+
+func (e *connectTimeoutError) Error() string {
+	which := "the request timed out"
+	if e.connectTimeout {
+		which = "the connect timeout ran out"
+	}
+	return fmt.Sprintf("timed out connecting to %s after %s, when %s; nothing answered, so the network or a firewall may be dropping packets: %s", e.addr, e.elapsed.Round(time.Millisecond), which, e.err)
+}
+
+func (e *connectTimeoutError) Unwrap() error   { return e.err }
+func (e *connectTimeoutError) Timeout() bool   { return true }
+func (e *connectTimeoutError) Temporary() bool { return true }
+
+// timeoutPhase describes which phase of a request timed out, if err is a
+// timeout once connected; connect timeouts describe themselves.
+func timeoutPhase(err error) string {
+	var cerr *connectTimeoutError
+	if errors.As(err, &cerr) {
+		return ""
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return "the connection was established, but the response didn't arrive in time"
+	}
+	return ""
+}
+
+// warnInsecure writes a warning that TLS verification is disabled. It's
+// written directly rather than logged, so no log level can hide it.
+func warnInsecure(w io.Writer) {
+	fmt.Fprint(w, `
+!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!
+!! WARNING: TLS certificate verification is DISABLED (-insecure).
+!! Any proxy or attacker on the network can read and modify these requests,
+!! including the credentials sent with them. Successful checks only show
+!! that the network path works, not that it is trustworthy. Use -ca-cert
+!! with your proxy's CA instead once reachability is confirmed.
+!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!
+
+`)
+}
+
+// loadCABundle returns the system's trusted certificates plus those in the
+// PEM file at path, such as the CA of a TLS-intercepting proxy.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA bundle: %s", err)
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		log.Printf("[WARN] Unable to load system certificates, only trusting %s: %s", path, err)
+		roots = x509.NewCertPool()
+	}
+
+	var found int
+	for rest := contents; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing certificate %d in CA bundle %s: %s", found+1, path, err)
+		}
+		roots.AddCert(cert)
+		found++
+	}
+	if found == 0 {
+		return nil, fmt.Errorf("Error loading CA bundle %s: no PEM-encoded certificates found", path)
+	}
+	return roots, nil
+}
+
+// proxyFunc returns the proxy selection function for the transport. By
+// default this honors HTTP_PROXY, HTTPS_PROXY, and NO_PROXY; a configured
+// ProxyURL replaces the first two while still respecting NO_PROXY.
+func (c *Config) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if c.ProxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	u, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy URL: %s", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("Invalid proxy URL %q: scheme must be one of http, https, or socks5", u.Redacted())
+	}
+
+	conf := httpproxy.FromEnvironment()
+	conf.HTTPProxy = c.ProxyURL
+	conf.HTTPSProxy = c.ProxyURL
+	proxyForURL := conf.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		proxy, err := proxyForURL(req.URL)
+		// SOCKS5 proxies can only be given credentials in their URL; HTTP
+		// proxies get them in ProxyConnectHeader instead.
+		if proxy != nil && proxy.Scheme == "socks5" && c.ProxyUser != "" {
+			withUser := *proxy
+			withUser.User = url.UserPassword(c.ProxyUser, c.ProxyPassword)
+			return &withUser, err
+		}
+		return proxy, err
+	}, nil
+}
+
+// userProjectTransport sets the X-Goog-User-Project header on every request,
+// which tells Google to charge quota and billing to that project.
+type userProjectTransport struct {
+	project   string
+	transport http.RoundTripper
+}
+
+func (t *userProjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the caller's request.
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Goog-User-Project", t.project)
+	return t.transport.RoundTrip(req)
+}
+
+// debugTransport logs a one line summary of every request, including token
+// requests, in addition to the full dumps the logging transport produces,
+// followed by the timing of each phase of the request.
+type debugTransport struct {
+	transport http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	req, trace := traceRequest(req)
+	resp, err := t.transport.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		log.Printf("[DEBUG] %s %s failed after %s: %s", req.Method, req.URL.Redacted(), elapsed, err)
+	} else {
+		log.Printf("[DEBUG] %s %s: %s in %s over %s", req.Method, req.URL.Redacted(), resp.Status, elapsed, resp.Proto)
+		logRateLimitHeaders(req.URL.Host, resp.Header)
+	}
+	log.Printf("[DEBUG]   -- Timings: %s", trace)
+	return resp, err
+}
+
+// logProxy logs whether requests to endpoint will traverse a proxy, so
+// NO_PROXY exclusions can be confirmed before any request is made.
+func logProxy(transport *http.Transport, endpoint string) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		log.Printf("[WARN] Unable to determine proxy for %s: %s", endpoint, err)
+		return
+	}
+	proxy, err := transport.Proxy(req)
+	switch {
+	case err != nil:
+		log.Printf("[WARN] Unable to determine proxy for %s: %s", endpoint, err)
+	case proxy == nil:
+		log.Printf("[INFO]   -- Proxy for %s: none (direct connection)", req.URL.Host)
+	default:
+		log.Printf("[INFO]   -- Proxy for %s: %s", req.URL.Host, proxy.Redacted())
+	}
+}
@@ -0,0 +1,159 @@
+package proxytest
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserProjectOverride(t *testing.T) {
+	tests := []struct {
+		name     string
+		override string
+		want     string
+	}{
+		{"override", "true", "quota-project"},
+		{"no override", "false", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, r.Header.Get("X-Goog-User-Project"))
+			}))
+			defer srv.Close()
+
+			t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "ya29.test")
+			t.Setenv("GOOGLE_BILLING_PROJECT", "quota-project")
+			t.Setenv("USER_PROJECT_OVERRIDE", tt.override)
+			conf, err := ConfigFromEnv(DefaultConfig())
+			if err != nil {
+				t.Fatalf("configFromEnv: %s", err)
+			}
+			if err := conf.LoadAndValidate(); err != nil {
+				t.Fatalf("LoadAndValidate: %s", err)
+			}
+
+			resp, err := conf.client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("X-Goog-User-Project = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserProjectTransportClonesRequest(t *testing.T) {
+	var got string
+	transport := &userProjectTransport{project: "quota-project", transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.Header.Get("X-Goog-User-Project")
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})}
+
+	req, err := http.NewRequest("GET", "https://cloudresourcemanager.googleapis.com/v1/projects/my-project", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if got != "quota-project" {
+		t.Errorf("X-Goog-User-Project = %q, want %q", got, "quota-project")
+	}
+	if h := req.Header.Get("X-Goog-User-Project"); h != "" {
+		t.Errorf("the caller's request was modified, with X-Goog-User-Project %q", h)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper that calls itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		caBundle string
+		success  bool
+	}{
+		{"without -ca-cert", "", false},
+		{"with -ca-cert", bundle, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DefaultConfig()
+			conf.AccessToken = "ya29.test"
+			conf.CABundle = tt.caBundle
+			if err := conf.LoadAndValidate(); err != nil {
+				t.Fatalf("LoadAndValidate: %s", err)
+			}
+
+			resp, err := conf.client.Get(srv.URL)
+			if tt.success {
+				if err != nil {
+					t.Fatalf("GET = %s, want success", err)
+				}
+				resp.Body.Close()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "certificate signed by unknown authority") {
+				t.Errorf("GET = %v, want a certificate verification error", err)
+			}
+		})
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	t.Run("refused without GCP_ALLOW_INSECURE", func(t *testing.T) {
+		t.Setenv("GCP_ALLOW_INSECURE", "")
+		conf := DefaultConfig()
+		conf.Insecure = true
+		if _, err := conf.newTransport(); err == nil || !strings.Contains(err.Error(), "requires GCP_ALLOW_INSECURE=1") {
+			t.Errorf("newTransport = %v, want it refused", err)
+		}
+	})
+
+	t.Run("warns with GCP_ALLOW_INSECURE", func(t *testing.T) {
+		t.Setenv("GCP_ALLOW_INSECURE", "1")
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stderr := os.Stderr
+		os.Stderr = w
+		defer func() { os.Stderr = stderr }()
+
+		conf := DefaultConfig()
+		conf.Insecure = true
+		transport, err := conf.newTransport()
+		os.Stderr = stderr
+		w.Close()
+		written, _ := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("newTransport: %s", err)
+		}
+		if !transport.TLSClientConfig.InsecureSkipVerify {
+			t.Error("InsecureSkipVerify = false, want true")
+		}
+		if !strings.Contains(string(written), "WARNING: TLS certificate verification is DISABLED") {
+			t.Errorf("stderr = %q, want the insecure warning", written)
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package proxytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// PrintValidation writes what was learned about c's credentials while
+// validating them, in the given output format, for -validate-only.
+func PrintValidation(w io.Writer, format string, c *Config) error {
+	var expiry *time.Time
+	if !c.token.Expiry.IsZero() {
+		// Drop the monotonic clock reading, which is meaningless to print.
+		e := c.token.Expiry.Round(0)
+		expiry = &e
+	}
+
+	if format == OutputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(struct {
+			Identity  string     `json:"identity"`
+			TokenType string     `json:"tokenType"`
+			Expiry    *time.Time `json:"expiry,omitempty"`
+		}{c.identity, c.token.Type(), expiry})
+	}
+
+	fmt.Fprintf(w, "Identity: %s\n", c.identity)
+	fmt.Fprintf(w, "Token type: %s\n", c.token.Type())
+	if expiry == nil {
+		_, err := fmt.Fprintln(w, "Token expiry: none")
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Token expiry: %s (in %s)\n", expiry, time.Until(*expiry).Round(time.Second))
+	return err
+}
@@ -0,0 +1,41 @@
+package proxytest
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/hashicorp/terraform/httpclient"
+	"github.com/terraform-providers/terraform-provider-google/version"
+)
+
+// toolVersion is the version of this tool. Release builds set it with
+//
+//	go build -ldflags "-X github.com/paddycarver/gcp-proxy-test/proxytest.toolVersion=v1.2.3"
+var toolVersion = "dev"
+
+// versionedModules are the dependencies whose versions are worth knowing
+// when reproducing a problem.
+var versionedModules = []string{
+	"golang.org/x/oauth2",
+	"google.golang.org/api",
+}
+
+// PrintVersion writes the versions of the tool, the Terraform and provider
+// code it was built against, its key dependencies, and Go.
+func PrintVersion(w io.Writer) {
+	fmt.Fprintf(w, "gcp-proxy-test %s\n", toolVersion)
+	fmt.Fprintf(w, "  %s\n", httpclient.UserAgentString())
+	fmt.Fprintf(w, "  terraform-provider-google/%s\n", version.ProviderVersion)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			for _, path := range versionedModules {
+				if dep.Path == path {
+					fmt.Fprintf(w, "  %s %s\n", dep.Path, dep.Version)
+				}
+			}
+		}
+	}
+	fmt.Fprintf(w, "  %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,121 @@
+package proxytest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// Watch runs the checks every interval until ctx is done, for watching a
+// terminal during a proxy change. Each run prints a timestamped line, and
+// changes between passing and failing, overall or of any check, are called
+// out. Once interrupted it prints the share of runs that passed. If stream
+// is set, every result and run is reported to it as it comes instead, e.g.
+// as JSON Lines, and the share of runs that passed is logged. It returns
+// whether the last run passed.
+func (c *Config) Watch(ctx context.Context, w io.Writer, interval time.Duration, color bool, stream Reporter) (bool, error) {
+	if interval <= 0 {
+		return false, fmt.Errorf("Watch interval must be positive, got %s", interval)
+	}
+	t := &textReporter{w: w, color: color}
+	var out Reporter = &quietReporter{w: io.Discard}
+	if stream != nil {
+		out = stream
+	}
+
+	var runs, passed int
+	var last Report
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		if c.ReloadCredentials && runs > 0 {
+			if change := c.reloadCredentials(); change != "" && stream == nil {
+				fmt.Fprintln(w, t.paint(ansiYellow, "  >>> "+change))
+			}
+		}
+		report := c.RunChecks(ctx, out)
+		// A run cut short by the interrupt says nothing about the network.
+		if ctx.Err() != nil {
+			break
+		}
+		runs++
+		if report.Success {
+			passed++
+		}
+		if stream != nil {
+			if err := stream.Finish(report); err != nil {
+				return false, err
+			}
+		} else {
+			line := fmt.Sprintf("%s %s", time.Now().Format(time.RFC3339), summarize(report))
+			if report.Success {
+				line = t.paint(ansiGreen, line)
+			} else {
+				line = t.paint(ansiRed, line)
+			}
+			fmt.Fprintln(w, line)
+			if runs > 1 {
+				for _, change := range transitions(last, report) {
+					fmt.Fprintln(w, t.paint(ansiYellow, "  >>> "+change))
+				}
+			}
+		}
+		last = report
+
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	if runs == 0 {
+		log.Printf("[WARN] Interrupted before any run finished")
+		return false, nil
+	}
+	uptime := fmt.Sprintf("Uptime: %d of %d runs passed (%.1f%%)", passed, runs, 100*float64(passed)/float64(runs))
+	if stream != nil {
+		log.Printf("[INFO] %s", uptime)
+	} else {
+		fmt.Fprintln(w, "\n"+uptime)
+	}
+	return last.Success, nil
+}
+
+// transitions describes every change between two runs: of the run as a
+// whole from reachable to unreachable or back, and of each check from
+// passing to failing or back.
+func transitions(prev, next Report) []string {
+	var changes []string
+	if prev.Success != next.Success {
+		changes = append(changes, fmt.Sprintf("TRANSITION: %s -> %s", reachability(prev.Success), reachability(next.Success)))
+	}
+	was, now := failedSet(prev), failedSet(next)
+	for _, chk := range checks {
+		switch {
+		case !was[chk.name] && now[chk.name]:
+			changes = append(changes, chk.name+" started failing")
+		case was[chk.name] && !now[chk.name]:
+			changes = append(changes, chk.name+" recovered")
+		}
+	}
+	return changes
+}
+
+// reachability describes whether a run passed.
+func reachability(success bool) string {
+	if success {
+		return "reachable"
+	}
+	return "unreachable"
+}
+
+// failedSet returns the names of the checks that failed in report.
+func failedSet(report Report) map[string]bool {
+	failed := make(map[string]bool)
+	for _, name := range failedChecks(report) {
+		failed[name] = true
+	}
+	return failed
+}